@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/schollz/patchitup/patchitup"
 )
@@ -12,17 +15,77 @@ func main() {
 		doDebug    bool
 		port       string
 		server     bool
+		useTLS     bool
+		serverConf string
 		pathToFile string
 		username   string
 		address    string
+		dryRun     bool
+		showPatch  bool
+		revisions  bool
+		diff       bool
+		from       string
+		to         string
+		asJSON     bool
+		pull       bool
+		at         string
+		output     string
+		compress   string
+		algorithm  string
+		commit     bool
+		message    string
+		commits    bool
+		commitID   string
+		tag        string
+		tags       bool
+		prune      bool
+		keep       int
+		watch      bool
+		remove     bool
+		pingHooks  bool
+		doSync     bool
+		profile    string
+		policy     string
+		toBundle   string
+		fromBundle string
 	)
 
-	flag.StringVar(&port, "port", "8002", "port to run server")
+	flag.StringVar(&port, "port", "", "port to run server (default: Listen of the configuration, or 8002)")
 	flag.StringVar(&pathToFile, "f", "", "path to the file to patch")
 	flag.StringVar(&username, "u", "", "username on the cloud")
-	flag.StringVar(&address, "s", "", "server name")
+	flag.StringVar(&address, "s", "", "server address, or a local directory like file:///mnt/backup")
 	flag.BoolVar(&doDebug, "debug", false, "enable debugging")
 	flag.BoolVar(&server, "host", false, "enable hosting")
+	flag.BoolVar(&useTLS, "tls", false, "host with TLS (the certificate is generated unless configured in .tls.toml)")
+	flag.StringVar(&serverConf, "config", "", "configuration file of the server (default: $PATCHITUP_CONFIG)")
+	flag.BoolVar(&dryRun, "dry", false, "report the patch that would be sent without uploading")
+	flag.BoolVar(&showPatch, "show-patch", false, "print the patch text during a dry run")
+	flag.BoolVar(&revisions, "revisions", false, "list the revisions of the file on the server")
+	flag.BoolVar(&diff, "diff", false, "show the changes to the file on the server between two revisions")
+	flag.StringVar(&from, "from", "", "revision to diff from (default: current)")
+	flag.StringVar(&to, "to", "", "revision to diff to (default: current)")
+	flag.BoolVar(&asJSON, "json", false, "output the diff as a JSON list of hunks")
+	flag.BoolVar(&pull, "pull", false, "download the file from the server")
+	flag.StringVar(&at, "at", "", "restore the file as it was at this time (e.g. 2018-02-23T03:00Z)")
+	flag.StringVar(&output, "o", "", "path to write the pulled file (default: the file)")
+	flag.StringVar(&compress, "compression", "", "preferred compression of patches (zstd, brotli, gzip or none)")
+	flag.StringVar(&algorithm, "algorithm", "", "diff algorithm of patches (diffmatchpatch or unified)")
+	flag.BoolVar(&commit, "commit", false, "upload the file and the files given as arguments as one commit")
+	flag.StringVar(&message, "m", "", "message of the commit or tag")
+	flag.BoolVar(&commits, "commits", false, "list the commits on the server (of the file, if given)")
+	flag.StringVar(&commitID, "id", "", "commit to pull, restoring all of its files to the folder -o")
+	flag.StringVar(&tag, "tag", "", "tag the uploaded revision (or the revision at -at) with a name")
+	flag.BoolVar(&tags, "tags", false, "list the tags of the file on the server")
+	flag.BoolVar(&prune, "prune", false, "squash the revisions of the file on the server from before -at, except tagged ones")
+	flag.IntVar(&keep, "keep", 0, "number of latest revisions to keep when pruning")
+	flag.BoolVar(&watch, "events", false, "print the changes to the files of the user on the server as they happen")
+	flag.BoolVar(&remove, "delete", false, "delete the file and its revisions from the server")
+	flag.BoolVar(&pingHooks, "test-webhooks", false, "send a test event to the webhooks of the user on the server")
+	flag.StringVar(&profile, "profile", "", "name of the server profile in the configuration to use, or several separated by commas to upload to each")
+	flag.StringVar(&policy, "policy", "all", "destinations that must succeed when uploading to several profiles (all, any or quorum)")
+	flag.StringVar(&toBundle, "bundle", "", "write the changes to the file and the files given as arguments to a bundle, without the server")
+	flag.StringVar(&fromBundle, "import", "", "import a bundle on the server (by default the server it was made for)")
+	flag.BoolVar(&doSync, "sync", false, "merge the changes to the file on the server since the last sync, then upload")
 	flag.Parse()
 
 	if doDebug {
@@ -30,12 +93,116 @@ func main() {
 	} else {
 		patchitup.SetLogLevel("info")
 	}
+	profiles := strings.Split(profile, ",")
+	if len(profiles) == 1 {
+		patchitup.SetProfile(profile)
+	}
 	var err error
 	if server {
 		patchitup.SetLogLevel("info")
+		patchitup.SetTLS(useTLS)
+		patchitup.SetServerConfiguration(serverConf)
 		err = patchitup.Run(port)
+	} else if revisions {
+		var revs []int64
+		revs, err = patchitup.ListRevisions(address, username, pathToFile)
+		for _, r := range revs {
+			fmt.Printf("%d\t%s\n", r, time.Unix(0, r*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+		}
+	} else if watch {
+		ch := make(chan patchitup.Event)
+		go func() {
+			for e := range ch {
+				b, _ := json.Marshal(e)
+				fmt.Println(string(b))
+			}
+		}()
+		err = patchitup.Subscribe(address, username, ch)
+	} else if pingHooks {
+		err = patchitup.PingWebhooks(address, username)
+	} else if remove {
+		err = patchitup.Delete(address, username, pathToFile)
+	} else if tags {
+		var ts []patchitup.TagInfo
+		ts, err = patchitup.ListTags(address, username, pathToFile)
+		for _, t := range ts {
+			fmt.Printf("%s\t%d\t%s\t%s\n", t.Name, t.Revision, time.Unix(0, t.Revision*int64(time.Millisecond)).UTC().Format(time.RFC3339), t.Message)
+		}
+	} else if tag != "" && at != "" {
+		err = patchitup.Tag(address, username, pathToFile, tag, message, at)
+	} else if prune {
+		err = patchitup.Prune(address, username, pathToFile, keep, at)
+	} else if commits {
+		var cs []patchitup.CommitInfo
+		cs, err = patchitup.ListCommits(address, username, pathToFile)
+		for _, c := range cs {
+			fmt.Printf("%s\t%s\t%s\t%s\n", c.ID, time.Unix(0, c.Revision*int64(time.Millisecond)).UTC().Format(time.RFC3339), strings.Join(c.Files, ","), c.Message)
+		}
+	} else if pull && commitID != "" {
+		err = patchitup.PullCommit(address, username, commitID, output)
+	} else if pull {
+		err = patchitup.Pull(address, username, pathToFile, at, output)
+	} else if toBundle != "" {
+		pathsToFiles := flag.Args()
+		if pathToFile != "" {
+			pathsToFiles = append([]string{pathToFile}, pathsToFiles...)
+		}
+		err = patchitup.CreateBundle(address, username, pathsToFiles, toBundle, patchitup.Options{
+			DryRun:        dryRun,
+			DiffAlgorithm: algorithm,
+		})
+	} else if fromBundle != "" {
+		var id string
+		id, err = patchitup.ImportBundle(address, fromBundle)
+		if id != "" {
+			fmt.Println(id)
+		}
+	} else if doSync {
+		_, err = patchitup.Sync(address, username, pathToFile, patchitup.Options{
+			DryRun:        dryRun,
+			ShowPatch:     showPatch,
+			Compression:   compress,
+			DiffAlgorithm: algorithm,
+		})
+	} else if diff {
+		var d string
+		d, err = patchitup.Diff(address, username, pathToFile, from, to, asJSON)
+		fmt.Print(d)
+	} else if commit {
+		pathsToFiles := flag.Args()
+		if pathToFile != "" {
+			pathsToFiles = append([]string{pathToFile}, pathsToFiles...)
+		}
+		var id string
+		id, err = patchitup.CommitFiles(address, username, pathsToFiles, message, patchitup.Options{
+			DryRun:        dryRun,
+			ShowPatch:     showPatch,
+			Compression:   compress,
+			DiffAlgorithm: algorithm,
+		})
+		if id != "" {
+			fmt.Println(id)
+		}
+	} else if len(profiles) > 1 {
+		destinations := make([]patchitup.Destination, len(profiles))
+		for i, p := range profiles {
+			destinations[i].Profile = p
+		}
+		_, err = patchitup.PatchUpTo(destinations, pathToFile, policy, patchitup.Options{
+			DryRun:        dryRun,
+			ShowPatch:     showPatch,
+			Compression:   compress,
+			DiffAlgorithm: algorithm,
+		})
 	} else {
-		err = patchitup.PatchUp(address, username, pathToFile)
+		err = patchitup.PatchUpWithOptions(address, username, pathToFile, patchitup.Options{
+			DryRun:        dryRun,
+			ShowPatch:     showPatch,
+			Compression:   compress,
+			DiffAlgorithm: algorithm,
+			Tag:           tag,
+			Message:       message,
+		})
 	}
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,87 @@
+package patchitup
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a compact summary of a set of line hashes, which can have
+// false positives but never false negatives.
+type bloomFilter struct {
+	Bits []byte `json:"bits"`
+	K    int    `json:"k"`
+}
+
+// maxBloomK is the most hash functions of a filter, and maxBloomSize the
+// most bytes of its bits, which are far more than a filter of any file
+// needs
+const (
+	maxBloomK    = 32
+	maxBloomSize = 16 * 1024 * 1024
+)
+
+// validate returns an error if a filter sent by a client can not be used,
+// before anything is hashed with it.
+func (b *bloomFilter) validate() error {
+	if b.K < 1 || b.K > maxBloomK {
+		return fmt.Errorf("filter must have 1 to %d hash functions, not %d", maxBloomK, b.K)
+	}
+	if len(b.Bits) == 0 {
+		return errors.New("filter has no bits")
+	}
+	if len(b.Bits) > maxBloomSize {
+		return fmt.Errorf("filter is larger than %d bytes", maxBloomSize)
+	}
+	return nil
+}
+
+// newBloomFilter returns a filter sized for n items with the given false
+// positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		Bits: make([]byte, (m+7)/8),
+		K:    k,
+	}
+}
+
+// locations returns the bits for an item, using double hashing
+func (b *bloomFilter) locations(s string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	m := uint64(len(b.Bits)) * 8
+	locations := make([]uint64, b.K)
+	for i := range locations {
+		locations[i] = (h1 + uint64(i)*h2) % m
+	}
+	return locations
+}
+
+func (b *bloomFilter) add(s string) {
+	for _, l := range b.locations(s) {
+		b.Bits[l/8] |= 1 << (l % 8)
+	}
+}
+
+func (b *bloomFilter) has(s string) bool {
+	if len(b.Bits) == 0 {
+		return false
+	}
+	for _, l := range b.locations(s) {
+		if b.Bits[l/8]&(1<<(l%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,284 @@
+package patchitup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// A bundle carries the patches of several files to a server that the
+// client can not reach, e.g. on a USB stick. The patches are made offline
+// against the cached copies of the files on the server, and the hash of
+// each copy is kept in the bundle so that the server only imports it on
+// top of the same files. Bundles have to be imported in the order that
+// they were made, since each one starts where the last one ended.
+
+// bundleFormat and bundleVersion identify a bundle file
+const (
+	bundleFormat  = "patchitup-bundle"
+	bundleVersion = 1
+)
+
+// bundle is a set of patches to the files of a user
+type bundle struct {
+	Format   string `json:"format"`
+	Version  int    `json:"version"`
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	// Created is when the bundle was made, in unix milliseconds
+	Created int64        `json:"created"`
+	Files   []bundleFile `json:"files"`
+}
+
+// bundleFile is the patch of one file in a bundle
+type bundleFile struct {
+	Filename string       `json:"filename"`
+	Patch    base64String `json:"patch"`
+	// BaseHash is the hash of the file on the server that the patch applies
+	// to, and Hash is the hash of the patched file
+	BaseHash string `json:"base_hash"`
+	Hash     string `json:"hash"`
+}
+
+// readBundle reads and checks a bundle file.
+func readBundle(pathToBundle string) (b bundle, err error) {
+	bBundle, err := ioutil.ReadFile(pathToBundle)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bBundle, &b)
+	if err != nil || b.Format != bundleFormat {
+		err = fmt.Errorf("'%s' is not a bundle", pathToBundle)
+		return
+	}
+	if b.Version > bundleVersion {
+		err = fmt.Errorf("bundle version %d is not supported", b.Version)
+	}
+	return
+}
+
+// importBundle applies every patch of the bundle to the data folder as one
+// commit, or none of them. Files that the bundle was already applied to are
+// skipped, so that importing a bundle twice does nothing.
+func importBundle(folder string, b bundle) (commit CommitInfo, err error) {
+	if b.Format != bundleFormat || b.Version > bundleVersion {
+		err = errors.New("unsupported bundle")
+		return
+	}
+	err = validateNames(b.Username)
+	if err != nil {
+		return
+	}
+	unlock := lockUser(b.Username)
+	defer unlock()
+
+	var files []commitFile
+	seen := make(map[string]struct{})
+	for _, f := range b.Files {
+		err = validateNames(f.Filename)
+		if err != nil {
+			return
+		}
+		if _, ok := seen[f.Filename]; ok {
+			err = fmt.Errorf("'%s' is in the bundle twice", f.Filename)
+			return
+		}
+		seen[f.Filename] = struct{}{}
+		pathToFile := path.Join(folder, b.Username, f.Filename)
+		hash := md5Text("")
+		if Exists(pathToFile) {
+			hash, err = Filemd5Sum(pathToFile)
+			if err != nil {
+				return
+			}
+		}
+		if hash == f.Hash {
+			log.Debugf("bundle already imported for '%s'", f.Filename)
+			continue
+		}
+		if hash != f.BaseHash {
+			err = fmt.Errorf("'%s' on the server is not the copy that the bundle was made from", f.Filename)
+			return
+		}
+		var newText string
+		newText, err = getPatchedText(pathToFile, string(f.Patch))
+		if err != nil {
+			err = errors.Wrapf(err, "problem patching '%s'", f.Filename)
+			return
+		}
+		if md5Text(newText) != f.Hash {
+			err = fmt.Errorf("patch of '%s' in the bundle does not match", f.Filename)
+			return
+		}
+		files = append(files, commitFile{
+			Filename: f.Filename,
+			Patch:    f.Patch,
+		})
+	}
+	if len(files) == 0 {
+		return
+	}
+	message := fmt.Sprintf("bundle of %s", time.Unix(0, b.Created*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+	return commitLocked(folder, b.Username, message, files)
+}
+
+func handlerBundle(c *gin.Context) {
+	commit, message, err := func(c *gin.Context) (commit CommitInfo, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		if sr.Bundle == nil {
+			err = errors.New("no bundle supplied")
+			return
+		}
+		if sr.Bundle.Username != sr.Username {
+			err = fmt.Errorf("bundle is for '%s'", sr.Bundle.Username)
+			return
+		}
+		log.Infof("%s bundle upload: %s", sr.Username, humanize.Bytes(uint64(c.Request.ContentLength)))
+		commit, err = importBundle(dataDir(c), *sr.Bundle)
+		if err != nil {
+			return
+		}
+		if commit.ID == "" {
+			message = "bundle already imported"
+			return
+		}
+		message = fmt.Sprintf("imported %d files as %s", len(commit.Files), commit.ID)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:  message,
+		Success:  err == nil,
+		Commit:   commit.ID,
+		Revision: commit.Revision,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// CreateBundle writes the patches of the files since they were last
+// uploaded into a bundle, without contacting the server. Once the bundle is
+// imported on the server with ImportBundle, the server has the files as
+// they are now.
+func CreateBundle(address, username string, pathsToFiles []string, pathToBundle string, opts Options) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	address, username = c.ServerAddress, c.Username
+	opts.diffAlgorithms = c.DiffAlgorithms
+	b := bundle{
+		Format:   bundleFormat,
+		Version:  bundleVersion,
+		Server:   address,
+		Username: username,
+		Created:  time.Now().UnixNano() / 1000000,
+	}
+	texts := make(map[string]string)
+	for _, pathToFile := range pathsToFiles {
+		_, filename := filepath.Split(pathToFile)
+		var text, baseText string
+		text, err = getFileText(pathToFile)
+		if err != nil {
+			return
+		}
+		// the cached copy is the file on the server, as far as the client knows
+		if Exists(pathToCachedCopy(address, username, filename)) {
+			baseText, err = getFileText(pathToCachedCopy(address, username, filename))
+			if err != nil {
+				return
+			}
+		}
+		if text == baseText {
+			continue
+		}
+		d := chooseDiffer(filename, len(text), opts.DiffAlgorithm, opts.diffAlgorithms, serverCapabilities())
+		var patch string
+		patch, err = compressPatchWith(d.Diff(filename, baseText, text), gzipCodec{}, d)
+		if err != nil {
+			return
+		}
+		b.Files = append(b.Files, bundleFile{
+			Filename: filename,
+			Patch:    base64String(patch),
+			BaseHash: md5Text(baseText),
+			Hash:     md5Text(text),
+		})
+		texts[filename] = text
+	}
+	if len(b.Files) == 0 {
+		log.Info("every file is up-to-date, no bundle written")
+		return
+	}
+	bBundle, err := json.Marshal(b)
+	if err != nil {
+		return
+	}
+	if opts.DryRun {
+		log.Infof("bundle of %d files would be %s", len(b.Files), humanize.Bytes(uint64(len(bBundle))))
+		return
+	}
+	err = ioutil.WriteFile(pathToBundle, bBundle, 0755)
+	if err != nil {
+		return
+	}
+	// the next bundle starts where this one ends
+	for filename, text := range texts {
+		os.MkdirAll(filepath.Dir(pathToCachedCopy(address, username, filename)), 0755)
+		err = ioutil.WriteFile(pathToCachedCopy(address, username, filename), []byte(text), 0755)
+		if err != nil {
+			return
+		}
+	}
+	log.Infof("wrote bundle of %d files to '%s' (%s)", len(b.Files), pathToBundle, humanize.Bytes(uint64(len(bBundle))))
+	return
+}
+
+// ImportBundle sends a bundle to the server, which applies all of its
+// patches as one commit. It returns the ID of the commit, which is empty if
+// the bundle was already imported.
+func ImportBundle(address, pathToBundle string) (id string, err error) {
+	defer log.Flush()
+	b, err := readBundle(pathToBundle)
+	if err != nil {
+		return
+	}
+	if address == "" {
+		address = b.Server
+	}
+	// the configuration has the certificates and the secret of the user
+	c, err := handleConfiguration(address, b.Username)
+	if err != nil {
+		return
+	}
+	address = c.ServerAddress
+	err = requireFeature(address, featureBundle)
+	if err != nil {
+		return
+	}
+	target, err := postToServer(address+"/bundle", serverRequest{
+		Username: b.Username,
+		Bundle:   &b,
+	})
+	if err != nil {
+		return
+	}
+	id = target.Commit
+	log.Infof("%s for '%s'", target.Message, b.Username)
+	return
+}
@@ -0,0 +1,179 @@
+package patchitup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/gin-gonic/gin"
+)
+
+// protocolVersion is the version of the protocol spoken by this server.
+// Version 1 servers only have /fileHash, /patch, /lineNumbers and
+// /lineText, and do not have /capabilities.
+const protocolVersion = 2
+
+// Features that a server can support
+const (
+	featureRevisions     = "revisions"
+	featureDiff          = "diff"
+	featureRestore       = "restore"
+	featureChunkedUpload = "chunked-upload"
+	featureReconstruct   = "reconstruct"
+	featureDictionary    = "zstd-dictionary"
+	featureCommit        = "commits"
+	featureTags          = "tags"
+	featureEvents        = "events"
+	featureWebhooks      = "webhooks"
+	featureReplication   = "replication"
+	featureBundle        = "bundles"
+	featureDelete        = "delete"
+)
+
+// capabilities describe what a server supports, so that clients can adapt
+// to older servers.
+type capabilities struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Encodings       []string `json:"encodings"`
+	Compression     []string `json:"compression"`
+	Diff            []string `json:"diff"`
+	Hash            []string `json:"hash"`
+	Auth            []string `json:"auth"`
+	Features        []string `json:"features"`
+	Limits          limits   `json:"limits"`
+}
+
+// limits are the limits of a server
+type limits struct {
+	// ChunkedUploadSize is the size above which patches should be uploaded in chunks
+	ChunkedUploadSize int `json:"chunked_upload_size,omitempty"`
+	// UploadChunkSize is the size of each chunk of a chunked upload
+	UploadChunkSize int `json:"upload_chunk_size,omitempty"`
+	// MaxFileSize is the size of the largest file, or zero for no limit
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+}
+
+// legacyCapabilities are assumed for servers without /capabilities
+var legacyCapabilities = capabilities{
+	ProtocolVersion: 1,
+	Encodings:       []string{"json"},
+	Compression:     []string{"gzip"},
+	Diff:            []string{"diffmatchpatch"},
+	Hash:            []string{"md5"},
+}
+
+// serverCapabilities returns the capabilities of this server.
+func serverCapabilities() (caps capabilities) {
+	caps = capabilities{
+		ProtocolVersion: protocolVersion,
+		Encodings:       []string{"json", "cbor"},
+		Compression:     codecNames,
+		Diff:            diffNames,
+		Hash:            []string{"md5"},
+		Auth:            []string{},
+		Features: []string{
+			featureRevisions,
+			featureDiff,
+			featureRestore,
+			featureChunkedUpload,
+			featureReconstruct,
+			featureDictionary,
+			featureCommit,
+			featureTags,
+			featureEvents,
+			featureWebhooks,
+			featureReplication,
+			featureBundle,
+			featureDelete,
+		},
+		Limits: limits{
+			ChunkedUploadSize: chunkedUploadSize,
+			UploadChunkSize:   uploadChunkSize,
+			MaxFileSize:       getLimits().MaxFileSize,
+		},
+	}
+	// patches that would be too large to send are uploaded in chunks
+	if max := int(getLimits().maxBodySize("/patch")) / 2; max < caps.Limits.ChunkedUploadSize {
+		caps.Limits.ChunkedUploadSize = max
+	}
+	return caps
+}
+
+func handlerCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, serverCapabilities())
+}
+
+// knownCapabilities caches the capabilities of each server
+var knownCapabilities = struct {
+	sync.Mutex
+	m map[string]capabilities
+}{m: make(map[string]capabilities)}
+
+// getCapabilities returns the capabilities of the server, which are fetched
+// once per server.
+func getCapabilities(address string) (caps capabilities, err error) {
+	knownCapabilities.Lock()
+	caps, ok := knownCapabilities.m[address]
+	knownCapabilities.Unlock()
+	if ok {
+		return
+	}
+
+	req, err := http.NewRequest("GET", address+"/capabilities", nil)
+	if err != nil {
+		return
+	}
+	resp, err := getTransport(address).do(req)
+	if err != nil {
+		if !isUnreachable(err) && !isCertificateError(err) {
+			err = unreachableError{err}
+		}
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		log.Debugf("%s does not have capabilities, assuming protocol version 1", address)
+		caps = legacyCapabilities
+	case resp.StatusCode >= 500:
+		err = unreachableError{fmt.Errorf("GET %s/capabilities: %s", address, resp.Status)}
+		return
+	default:
+		err = json.NewDecoder(resp.Body).Decode(&caps)
+		if err != nil {
+			return
+		}
+		log.Debugf("%s speaks protocol version %d", address, caps.ProtocolVersion)
+	}
+	if contains(caps.Encodings, "cbor") {
+		setSupportsBinary(address)
+	}
+
+	knownCapabilities.Lock()
+	knownCapabilities.m[address] = caps
+	knownCapabilities.Unlock()
+	return
+}
+
+// requireFeature returns an error if the server does not support the feature.
+func requireFeature(address, feature string) (err error) {
+	caps, err := getCapabilities(address)
+	if err != nil {
+		return
+	}
+	if !contains(caps.Features, feature) {
+		err = fmt.Errorf("server does not support %s (protocol version %d)", feature, caps.ProtocolVersion)
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/cihub/seelog"
@@ -20,48 +24,141 @@ import (
 type clientConfiguration struct {
 	ServerAddress string
 	Username      string
+	// Timeout is the timeout of a request, in seconds
+	Timeout int `toml:",omitempty"`
+	// Retries is the number of times a request is retried when the server can not be reached
+	Retries int `toml:",omitempty"`
+	// Compression is the preferred compression of patches (zstd, brotli, gzip or none)
+	Compression string `toml:",omitempty"`
+	// DiffAlgorithms are the diff algorithms (diffmatchpatch or unified) of
+	// the files matching each pattern, e.g. "*.sql" = "unified"
+	DiffAlgorithms map[string]string `toml:",omitempty"`
+	// Profiles are named servers, e.g. [Profiles.staging], whose settings
+	// override the ones above when the profile is used
+	Profiles map[string]clientConfiguration `toml:",omitempty"`
+	// CA is the certificate authority that the certificate of the server
+	// must be signed by, e.g. its self-signed certificate
+	CA string `toml:",omitempty"`
+	// Cert and Key are the certificate of the client, if the server requires one
+	Cert string `toml:",omitempty"`
+	Key  string `toml:",omitempty"`
+	// Secret signs the requests of the user, if the server has a secret for them
+	Secret string `toml:",omitempty"`
+}
+
+// profile is the name of the profile in the configuration that is used, or
+// empty for the default one
+var profile string
+
+// SetProfile determines the profile of the configuration that is used.
+func SetProfile(name string) {
+	profile = name
 }
 
 func handleConfiguration(address, username string) (c clientConfiguration, err error) {
+	return handleProfileConfiguration(profile, address, username)
+}
+
+// handleProfileConfiguration loads the configuration of the profile, or the
+// default configuration if profile is empty.
+func handleProfileConfiguration(profile, address, username string) (c clientConfiguration, err error) {
 	configFile := path.Join(UserHomeDir(), ".patchitup", "client", "config.toml")
 	bConfig, err := ioutil.ReadFile(configFile)
 	newConfig := false
+	var config clientConfiguration
 	if err == nil {
-		err2 := toml.Unmarshal(bConfig, &c)
+		err2 := toml.Unmarshal(bConfig, &config)
 		if err2 != nil {
 			err = err2
 			return
 		}
 	} else {
 		newConfig = true
-		c = clientConfiguration{}
+	}
+	// the names are stored in the profile, if one is used
+	names := &config
+	var p clientConfiguration
+	if profile != "" {
+		err = validateNames(profile)
+		if err != nil {
+			return
+		}
+		p = config.Profiles[profile]
+		names = &p
 	}
 	// supplied names always override
 	if username != "" {
-		c.Username = username
+		names.Username = username
 	}
 	if address != "" {
-		c.ServerAddress = address
+		names.ServerAddress = address
 	}
 
 	// check that they are not empty
-	if c.Username == "" {
+	if names.Username == "" {
 		// supply a random username
-		c.Username = RandStringBytesMaskImprSrc(10)
-		log.Infof("your username is '%s'\n", c.Username)
+		names.Username = RandStringBytesMaskImprSrc(10)
+		log.Infof("your username is '%s'\n", names.Username)
 	}
-	if c.ServerAddress == "" {
+	if names.ServerAddress == "" {
+		if profile != "" {
+			err = fmt.Errorf("must supply address (-s) for profile '%s'", profile)
+			return
+		}
 		err = errors.New("must supply address (-s)")
 		return
 	}
 
+	c = config
+	c.Profiles = nil
+	if profile != "" {
+		if config.Profiles == nil {
+			config.Profiles = make(map[string]clientConfiguration)
+		}
+		config.Profiles[profile] = p
+		c.ServerAddress, c.Username = p.ServerAddress, p.Username
+		if p.Timeout > 0 {
+			c.Timeout = p.Timeout
+		}
+		if p.Retries > 0 {
+			c.Retries = p.Retries
+		}
+		if p.Compression != "" {
+			c.Compression = p.Compression
+		}
+		if len(p.DiffAlgorithms) > 0 {
+			c.DiffAlgorithms = p.DiffAlgorithms
+		}
+		if p.CA != "" {
+			c.CA = p.CA
+		}
+		if p.Cert != "" {
+			c.Cert, c.Key = p.Cert, p.Key
+		}
+		if p.Secret != "" {
+			c.Secret = p.Secret
+		}
+	}
+	setRequestSettings(c)
+	err = setClientTLS(c)
+	if err != nil {
+		return
+	}
+	setClientSecret(c)
+
 	// save the configuration
 	buf := new(bytes.Buffer)
-	err = toml.NewEncoder(buf).Encode(c)
+	err = toml.NewEncoder(buf).Encode(config)
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(configFile, buf.Bytes(), 0755)
+	// only the user can read the configuration, since it has their secret
+	// and the path to their key, including one written before
+	err = ioutil.WriteFile(configFile, buf.Bytes(), 0600)
+	if err != nil {
+		return
+	}
+	err = os.Chmod(configFile, 0600)
 	if err != nil {
 		return
 	}
@@ -71,8 +168,32 @@ func handleConfiguration(address, username string) (c clientConfiguration, err e
 	return
 }
 
+// Options modify the behavior of PatchUp.
+type Options struct {
+	// DryRun computes the patch that would be sent, reports it and does not upload it.
+	DryRun bool
+	// ShowPatch prints the human-readable patch text during a dry run.
+	ShowPatch bool
+	// Compression is the preferred compression of patches, overriding the configuration.
+	Compression string
+	// DiffAlgorithm is the diff algorithm of the patch, overriding the configuration.
+	// By default large files are diffed by line and others by character.
+	DiffAlgorithm string
+	// Tag names the uploaded revision, or the latest revision if the file is up-to-date.
+	Tag string
+	// Message is the message of the tag.
+	Message string
+	// diffAlgorithms are the diff algorithms of each pattern in the configuration
+	diffAlgorithms map[string]string
+}
+
 // PatchUp will take a filename and upload it to the server via a patch using the specified user.
 func PatchUp(address, username, pathToFile string) (err error) {
+	return PatchUpWithOptions(address, username, pathToFile, Options{})
+}
+
+// PatchUpWithOptions is PatchUp with additional options, e.g. for a dry run.
+func PatchUpWithOptions(address, username, pathToFile string, opts Options) (err error) {
 	// make the directory for the client
 	os.MkdirAll(path.Join(UserHomeDir(), ".patchitup", "client"), 0755)
 
@@ -86,95 +207,371 @@ func PatchUp(address, username, pathToFile string) (err error) {
 	}
 	address = c.ServerAddress
 	username = c.Username
+	if opts.Compression == "" {
+		opts.Compression = c.Compression
+	}
+	opts.diffAlgorithms = c.DiffAlgorithms
 
 	// generate the filename
 	_, filename := filepath.Split(pathToFile)
 
-	// first make sure the file to upload exists
-	log.Debugf("check if '%s' exists", pathToFile)
-	if !Exists(pathToFile) {
-		return fmt.Errorf("'%s' not found", pathToFile)
+	// upload anything that was queued while the server was unreachable, except
+	// for this file which is about to be uploaded anyway
+	if !opts.DryRun {
+		removeFromQueue(address, username, filename)
+		err = flushQueue(opts)
+		if err != nil {
+			log.Warnf("server still unreachable: %s", err)
+		}
 	}
 
-	// check if cache folder exists
-	if !Exists(path.Join(pathToCacheClient, username)) {
-		log.Debugf("making cache folder for user '%s'", username)
-		os.MkdirAll(path.Join(pathToCacheClient, username), 0755)
+	err = patchUp(address, username, pathToFile, filename, opts)
+	if isUnreachable(err) && !opts.DryRun {
+		log.Warnf("server unreachable, will upload '%s' next time: %s", filename, err)
+		return addToQueue(address, username, pathToFile, filename, opts)
 	}
-	pathToRemoteCopy := path.Join(pathToCacheClient, username, filename)
+	return
+}
 
-	// copy current state of file
-	err = CopyFile(pathToFile, filename+".temp")
-	defer os.Remove(filename + ".temp")
+// patchUp uploads the file at pathToFile to filename on the server.
+func patchUp(address, username, pathToFile, filename string, opts Options) (err error) {
+	s, err := takeSnapshot(pathToFile)
 	if err != nil {
 		return
 	}
+	defer s.remove()
+	return patchUpSnapshot(address, username, s, filename, opts)
+}
 
-	// get the latest hash from remote
-	localHash, err := Filemd5Sum(pathToFile)
+// patchUpSnapshot uploads the snapshot of a file to filename on the server.
+func patchUpSnapshot(address, username string, s snapshot, filename string, opts Options) (err error) {
+	pathToFile := s.pathToFile
+	resetBandwidth(address, username)
+	caps, err := getCapabilities(address)
+	if err != nil {
+		return
+	}
+	p, err := preparePatch(address, username, s, filename, caps, opts)
+	if err != nil {
+		return
+	}
+	if p.upToDate {
+		if opts.Tag != "" && !opts.DryRun {
+			err = Tag(address, username, pathToFile, opts.Tag, opts.Message, "")
+		}
+		return
+	}
+	if opts.DryRun {
+		p.report(pathToFile, username, opts)
+		return
+	}
+
+	if max := caps.Limits.MaxFileSize; max > 0 && int64(len(p.text)) > max {
+		return fmt.Errorf("'%s' is larger than the limit of %s on the server", filename, humanize.Bytes(uint64(max)))
+	}
+
+	// upload patches
+	chunked := contains(caps.Features, featureChunkedUpload)
+	if chunked && len(p.patch) > caps.Limits.ChunkedUploadSize {
+		err = uploadPatchesChunked(p.patch, address, username, filename, caps.Limits.UploadChunkSize, opts.Tag, opts.Message)
+	} else {
+		err = uploadPatches(p.patch, address, username, filename, opts.Tag, opts.Message)
+		if errors.Cause(err) == errTooLarge && chunked {
+			log.Infof("patch of %s is too large for the server, uploading it in chunks", humanize.Bytes(uint64(len(p.patch))))
+			err = uploadPatchesChunked(p.patch, address, username, filename, caps.Limits.UploadChunkSize, opts.Tag, opts.Message)
+		}
+	}
 	if err != nil {
+		return err
+	} else {
+		transferred, transferredJSON := getBandwidth(address, username)
+		encoding := ""
+		if transferred < transferredJSON {
+			encoding = fmt.Sprintf(", binary saved %s", humanize.Bytes(uint64(transferredJSON-transferred)))
+		}
+		log.Infof("patched %s (%2.1f%%) to remote '%s' for '%s' (transferred %s%s)", humanize.Bytes(uint64(len(p.patch))), 100*float64(len(p.patch))/float64(len(p.text)), filename, username, humanize.Bytes(uint64(transferred)), encoding)
+	}
+
+	err = p.updateRemoteCopy()
+	if err != nil {
+		return err
+	}
+
+	log.Info("remote server is up-to-date")
+	return
+}
+
+// preparedPatch is the patch of a file that is ready to be uploaded
+type preparedPatch struct {
+	filename         string
+	pathToRemoteCopy string
+	// text is the local text of the file
+	text         string
+	patchText    string
+	patch        string
+	differ       differ
+	codec        codec
+	linesFetched int
+	// upToDate is set if the server already has the file
+	upToDate bool
+}
+
+// unsafeServerChars are replaced in the name of the cache folder of a server
+var unsafeServerChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// pathToCachedCopy is where the copy of a file on a server is cached, which
+// is kept apart for every server so that uploading the same file to several
+// servers does not mix up their copies.
+func pathToCachedCopy(address, username, filename string) string {
+	server := address
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	server = strings.Trim(unsafeServerChars.ReplaceAllString(server, "_"), "_")
+	return path.Join(pathToCacheClient, "remote", server, username, filename)
+}
+
+// snapshot is a copy of a file taken before it is patched up, so that the
+// file can change while the patches are made
+type snapshot struct {
+	pathToFile string
+	pathToCopy string
+	// hash is the hash of the copy
+	hash string
+}
+
+// takeSnapshot copies the file to a temporary file of its own, so that
+// several uploads of the file can run at once.
+func takeSnapshot(pathToFile string) (s snapshot, err error) {
+	// first make sure the file to upload exists
+	log.Debugf("check if '%s' exists", pathToFile)
+	if !Exists(pathToFile) {
+		err = fmt.Errorf("'%s' not found", pathToFile)
 		return
 	}
-	remoteHash, err := getLatestHash(address, username, pathToFile)
+	f, err := ioutil.TempFile("", "patchitup")
+	if err != nil {
+		return
+	}
+	f.Close()
+	s = snapshot{
+		pathToFile: pathToFile,
+		pathToCopy: f.Name(),
+	}
+	err = CopyFile(pathToFile, s.pathToCopy)
+	if err == nil {
+		s.hash, err = Filemd5Sum(s.pathToCopy)
+	}
+	if err != nil {
+		s.remove()
+	}
+	return
+}
+
+func (s snapshot) remove() {
+	os.Remove(s.pathToCopy)
+}
+
+// preparePatch makes the patch from the copy of the file on the server to
+// the snapshot of the file, reconstructing the copy if needed.
+func preparePatch(address, username string, s snapshot, filename string, caps capabilities, opts Options) (p preparedPatch, err error) {
+	p.filename = filename
+
+	// check if cache folder exists
+	p.pathToRemoteCopy = pathToCachedCopy(address, username, filename)
+	if !Exists(filepath.Dir(p.pathToRemoteCopy)) {
+		log.Debugf("making cache folder for user '%s'", username)
+		os.MkdirAll(filepath.Dir(p.pathToRemoteCopy), 0755)
+	}
+
+	// get the latest hash from remote
+	localHash := s.hash
+	remoteHash, err := getLatestHash(address, username, filename)
 	if err != nil {
 		return
 	}
 	log.Debugf("local hash: %s", localHash)
 	log.Debugf("remote hash: %s", remoteHash)
 	if localHash == remoteHash {
-		log.Info("remote server is up-to-date")
+		log.Infof("remote server is up-to-date for '%s'", filename)
+		p.upToDate = true
 		return
 	}
 
 	// check hash of the cached remote copy and the remote copy
-	localRemoteHash, err := Filemd5Sum(pathToRemoteCopy)
+	localRemoteHash, err := Filemd5Sum(p.pathToRemoteCopy)
 	log.Debugf("local remote hash: %s", localRemoteHash)
+	var localRemoteText string
 	if localRemoteHash != remoteHash {
 		// local remote copy and remote is out of data
 		// reconstruct file from remote
 		log.Debug("reconstructing from remote")
-		remoteCopyText, err := reconstructCopyFromRemote(address, username, filename)
+		localRemoteText, p.linesFetched, err = reconstructCopyFromRemote(address, username, filename, s.pathToCopy)
 		if err != nil {
-			return errors.Wrap(err, "problem reconstructing: ")
+			err = errors.Wrap(err, "problem reconstructing: ")
+			return
+		}
+		// a dry run leaves the cached copy alone
+		if !opts.DryRun {
+			err = ioutil.WriteFile(p.pathToRemoteCopy, []byte(localRemoteText), 0755)
+			if err != nil {
+				return
+			}
 		}
-		err = ioutil.WriteFile(pathToRemoteCopy, []byte(remoteCopyText), 0755)
 	} else {
 		// local remote copy replicate of the remote file, so it can be used to generate diff
 		log.Debug("local remote is up-to-date, not reconstructing")
+		localRemoteText, err = getFileText(p.pathToRemoteCopy)
+		if err != nil {
+			return
+		}
 	}
 
 	// get patches between the local version and the local remote version
-	localRemoteText, err := getFileText(pathToRemoteCopy)
-	if err != nil {
-		return err
-	}
-	localText, err := getFileText(filename + ".temp")
+	p.text, err = getFileText(s.pathToCopy)
 	if err != nil {
-		return err
+		return
 	}
-	patch := getPatch(localRemoteText, localText)
+	p.differ = chooseDiffer(filename, len(p.text), opts.DiffAlgorithm, opts.diffAlgorithms, caps)
+	p.patchText = p.differ.Diff(filename, localRemoteText, p.text)
+	p.codec = getPatchCodec(address, username, filename, caps, opts.Compression)
+	p.patch, err = compressPatchWith(p.patchText, p.codec, p.differ)
+	return
+}
 
-	// upload patches
-	err = uploadPatches(patch, address, username, pathToFile)
-	if err != nil {
-		return err
-	} else {
-		log.Infof("patched %s (%2.1f%%) to remote '%s' for '%s'", humanize.Bytes(uint64(len(patch))), 100*float64(len(patch))/float64(len(localText)), filename, username)
+// report logs the patch that would be sent in a dry run.
+func (p preparedPatch) report(pathToFile, username string, opts Options) {
+	log.Infof("dry run for '%s' on remote '%s' for '%s'", pathToFile, p.filename, username)
+	log.Infof("patch size with %s: %s", p.differ.Name(), humanize.Bytes(uint64(len(p.patchText))))
+	log.Infof("compressed size with %s: %s (%2.1f%% of %s)", p.codec.Name(), humanize.Bytes(uint64(len(p.patch))), 100*float64(len(p.patch))/float64(len(p.text)), humanize.Bytes(uint64(len(p.text))))
+	log.Infof("lines fetched for reconstruction: %d", p.linesFetched)
+	if opts.ShowPatch {
+		log.Flush()
+		fmt.Println(p.patchText)
 	}
+}
 
-	// update the local remote copy
-	err = ioutil.WriteFile(pathToRemoteCopy, convertWindowsLineFeed.ReplaceAll([]byte(localText), []byte("\n")), 0755)
-	if err != nil {
-		return err
-	}
+// updateRemoteCopy updates the cached copy of the file on the server after
+// the patch was uploaded.
+func (p preparedPatch) updateRemoteCopy() error {
+	return ioutil.WriteFile(p.pathToRemoteCopy, convertWindowsLineFeed.ReplaceAll([]byte(p.text), []byte("\n")), 0755)
+}
 
-	log.Info("remote server is up-to-date")
+// httpClient is used for all requests to the server, with the timeout of
+// the server of each request
+var httpClient = &http.Client{}
+
+// defaultTimeout is the timeout of a request, unless configured
+const defaultTimeout = 60 * time.Second
+
+// maxRetries and retryBackoff determine how idempotent requests are
+// retried when the server can not be reached
+var (
+	maxRetries   = 5
+	retryBackoff = 1 * time.Second
+)
+
+// requestSettings are the timeout and retries of the requests to a server
+type requestSettings struct {
+	timeout time.Duration
+	retries int
+}
+
+// serverSettings are the request settings of each server as configured, so
+// that uploads to several servers each use their own
+var serverSettings = struct {
+	sync.Mutex
+	servers map[string]requestSettings
+}{servers: make(map[string]requestSettings)}
+
+// setRequestSettings keeps the request settings of the server of the
+// configuration.
+func setRequestSettings(c clientConfiguration) {
+	serverSettings.Lock()
+	serverSettings.servers[c.ServerAddress] = requestSettings{
+		timeout: time.Duration(c.Timeout) * time.Second,
+		retries: c.Retries,
+	}
+	serverSettings.Unlock()
+}
+
+// getRequestSettings returns the request settings of the server of the
+// address, or the defaults for the ones that are not configured.
+func getRequestSettings(address string) (settings requestSettings) {
+	serverSettings.Lock()
+	matched := ""
+	for server, s := range serverSettings.servers {
+		if strings.HasPrefix(address+"/", server+"/") && len(server) > len(matched) {
+			matched, settings = server, s
+		}
+	}
+	serverSettings.Unlock()
+	if settings.timeout <= 0 {
+		settings.timeout = defaultTimeout
+	}
+	if settings.retries <= 0 {
+		settings.retries = maxRetries
+	}
 	return
 }
 
-// postToServer is generic function to post to the server
+// unreachableError is returned when the server could not be reached or was
+// unavailable, in which case the request can be tried again later.
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string {
+	return e.err.Error()
+}
+
+// errNotFound is returned when the server does not have an endpoint
+var errNotFound = errors.New("not found on server")
+
+func isUnreachable(err error) bool {
+	_, ok := errors.Cause(err).(unreachableError)
+	return ok
+}
+
+// postToServerRetry is postToServer for idempotent requests, which are retried
+// with exponential backoff if the server can not be reached.
+func postToServerRetry(address string, sr serverRequest) (target serverResponse, err error) {
+	backoff := retryBackoff
+	retries := getRequestSettings(address).retries
+	for i := 0; ; i++ {
+		target, err = postToServer(address, sr)
+		if err == nil || !isUnreachable(err) || i >= retries {
+			return
+		}
+		// add jitter so that clients do not retry in lockstep
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		log.Debugf("retrying %s in %s: %s", address, wait, err)
+		time.Sleep(wait)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// postToServer is generic function to post to the server. Requests that
+// the server refuses because of their rate were not handled, so they are
+// sent again after the wait the server asks for.
 func postToServer(address string, sr serverRequest) (target serverResponse, err error) {
-	payloadBytes, err := json.Marshal(sr)
+	retries := getRequestSettings(address).retries
+	for i := 0; ; i++ {
+		target, err = sendToServer(address, sr)
+		limited, ok := errors.Cause(err).(rateLimitedError)
+		if !ok || i >= retries {
+			return
+		}
+		log.Debugf("retrying %s in %s: %s", address, limited.wait, err)
+		time.Sleep(limited.wait)
+	}
+}
+
+// sendToServer posts a request to the server once.
+func sendToServer(address string, sr serverRequest) (target serverResponse, err error) {
+	payloadBytes, contentType, err := encodeRequest(address, sr)
 	if err != nil {
 		return
 	}
@@ -184,18 +581,57 @@ func postToServer(address string, sr serverRequest) (target serverResponse, err
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", contentTypeBinary+", "+contentTypeJSON)
+	err = signRequest(req, sr.Username, payloadBytes)
+	if err != nil {
+		return
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := getTransport(address).do(req)
 	if err != nil {
+		if !isUnreachable(err) && !isCertificateError(err) {
+			err = unreachableError{err}
+		}
 		return
 	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = errors.Wrap(errNotFound, address)
+		return
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		err = errors.Wrap(errTooLarge, address)
+		return
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err = rateLimitedError{fmt.Errorf("POST %s: %s", address, resp.Status), retryAfter(resp)}
+		return
+	case resp.StatusCode >= 500:
+		err = unreachableError{fmt.Errorf("POST %s: %s", address, resp.Status)}
+		return
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&target)
+	bResp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = unreachableError{err}
+		return
+	}
+	err = decodeResponse(address, resp.Header.Get("Content-Type"), bResp, &target)
 	if err != nil {
 		return
 	}
+
+	// keep track of how much the binary encoding saves
+	jsonSent, jsonReceived := len(payloadBytes), len(bResp)
+	if contentType == contentTypeBinary {
+		bJSON, _ := json.Marshal(sr)
+		jsonSent = len(bJSON)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), contentTypeJSON) {
+		bJSON, _ := json.Marshal(target)
+		jsonReceived = len(bJSON)
+	}
+	addBandwidth(address, sr.Username, len(payloadBytes)+len(bResp), jsonSent+jsonReceived)
 	if !target.Success {
 		err = errors.New(target.Message)
 	}
@@ -211,19 +647,21 @@ func getLatestHash(address, username, pathToFile string) (fileHash string, err e
 		Username: username,
 		Filename: filename,
 	}
-	target, err := postToServer(address+"/fileHash", sr)
+	target, err := postToServerRetry(address+"/fileHash", sr)
 	fileHash = target.Message
 	return
 }
 
 // uploadPatches will upload the patch to the server
-func uploadPatches(patch string, address, username, pathToFile string) (err error) {
+func uploadPatches(patch string, address, username, pathToFile, tag, message string) (err error) {
 	_, filename := filepath.Split(pathToFile)
 
 	sr := serverRequest{
 		Username: username,
 		Filename: filename,
-		Patch:    patch,
+		Patch:    base64String(patch),
+		Tag:      tag,
+		Message:  message,
 	}
 	_, err = postToServer(address+"/patch", sr)
 	return
@@ -239,17 +677,15 @@ func getRemoteCopyHashLineNumbers(address, username, pathToFile string) (hashLin
 		Username: username,
 		Filename: filename,
 	}
-	target, err := postToServer(address+"/lineNumbers", sr)
+	target, err := postToServerRetry(address+"/lineNumbers", sr)
 	hashLineNumbers = target.HashLinenumbers
 	return
 }
 
-func getRemoteCopyHashLines(remoteHashLineNumbers map[string][]int, address, username, pathToFile string) (hashLines map[string][]byte, err error) {
+func getRemoteCopyHashLines(remoteHashLineNumbers map[string][]int, address, username, filename, pathToLocalCopy string) (hashLines map[string][]byte, linesFetched int, err error) {
 	hashLines = make(map[string][]byte)
 
-	_, filename := filepath.Split(pathToFile)
-
-	pathToRemoteCopy := path.Join(pathToCacheClient, username, filename)
+	pathToRemoteCopy := pathToCachedCopy(address, username, filename)
 	if !Exists(pathToRemoteCopy) {
 		newFile, err2 := os.Create(pathToRemoteCopy)
 		if err2 != nil {
@@ -270,7 +706,7 @@ func getRemoteCopyHashLines(remoteHashLineNumbers map[string][]int, address, use
 	defer file.Close()
 
 	log.Debug("determining which lines in current file are in the remote copy")
-	hashLines, err = getHashLines(filename + ".temp")
+	hashLines, err = getHashLines(pathToLocalCopy)
 	if err != nil {
 		return
 	}
@@ -292,7 +728,11 @@ func getRemoteCopyHashLines(remoteHashLineNumbers map[string][]int, address, use
 		Filename:     filename,
 		MissingLines: missingLines,
 	}
-	target, err := postToServer(address+"/lineText", sr)
+	target, err := postToServerRetry(address+"/lineText", sr)
+	if err != nil {
+		return
+	}
+	linesFetched = len(target.HashLineText)
 
 	for line := range target.HashLineText {
 		hashLines[line] = target.HashLineText[line]
@@ -300,13 +740,25 @@ func getRemoteCopyHashLines(remoteHashLineNumbers map[string][]int, address, use
 	return
 }
 
-func reconstructCopyFromRemote(address, username, pathToFile string) (reconstructedFile string, err error) {
-	remoteHashLineNumbers, err := getRemoteCopyHashLineNumbers(address, username, pathToFile)
+// reconstructCopyFromRemote rebuilds the copy of filename on the server,
+// fetching only the lines that are not already in the local copy. It returns
+// the reconstructed text and the number of lines that had to be fetched.
+func reconstructCopyFromRemote(address, username, filename, pathToLocalCopy string) (reconstructedFile string, linesFetched int, err error) {
+	if requireFeature(address, featureReconstruct) == nil {
+		return reconstructWithFilter(address, username, filename, pathToLocalCopy)
+	}
+	// older servers need the line numbers of every line
+	log.Debug("server does not support filters, getting line numbers")
+	return reconstructCopyFromLineNumbers(address, username, filename, pathToLocalCopy)
+}
+
+func reconstructCopyFromLineNumbers(address, username, filename, pathToLocalCopy string) (reconstructedFile string, linesFetched int, err error) {
+	remoteHashLineNumbers, err := getRemoteCopyHashLineNumbers(address, username, filename)
 	if err != nil {
 		return
 	}
 
-	hashLines, err := getRemoteCopyHashLines(remoteHashLineNumbers, address, username, pathToFile)
+	hashLines, linesFetched, err := getRemoteCopyHashLines(remoteHashLineNumbers, address, username, filename, pathToLocalCopy)
 	if err != nil {
 		return
 	}
@@ -332,3 +784,103 @@ func reconstructCopyFromRemote(address, username, pathToFile string) (reconstruc
 	reconstructedFile = strings.Join(lines, "\n")
 	return
 }
+
+// ListRevisions returns the revisions of a file stored on the server.
+func ListRevisions(address, username, pathToFile string) (revisions []int64, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureRevisions)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	sr := serverRequest{
+		Username: c.Username,
+		Filename: filename,
+	}
+	target, err := postToServerRetry(c.ServerAddress+"/revisions", sr)
+	revisions = target.Revisions
+	return
+}
+
+// Diff returns the unified diff of a file stored on the server between two
+// revisions, where an empty revision or "current" is the current copy. If
+// asJSON is set the diff is returned as a JSON list of hunks.
+func Diff(address, username, pathToFile, from, to string, asJSON bool) (diff string, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureDiff)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	sr := serverRequest{
+		Username: c.Username,
+		Filename: filename,
+		From:     from,
+		To:       to,
+	}
+	if asJSON {
+		sr.Format = "json"
+	}
+	target, err := postToServerRetry(c.ServerAddress+"/diff", sr)
+	if err != nil {
+		return
+	}
+	if !asJSON {
+		diff = string(target.Data)
+		return
+	}
+	bHunks, err := json.MarshalIndent(target.Hunks, "", "  ")
+	diff = string(bHunks)
+	return
+}
+
+// Pull downloads a file from the server and writes it to pathToOutput, or
+// over pathToFile if pathToOutput is empty. If at is set, the file is
+// restored as it was at that time, i.e. the latest revision at or before
+// it. The copy on the server is never changed.
+func Pull(address, username, pathToFile, at, pathToOutput string) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureRestore)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	if pathToOutput == "" {
+		pathToOutput = pathToFile
+	}
+	sr := serverRequest{
+		Username: c.Username,
+		Filename: filename,
+		At:       at,
+	}
+	target, err := postToServerRetry(c.ServerAddress+"/restore", sr)
+	if err != nil {
+		return
+	}
+	text, err := decompressPatch(string(target.Data))
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(pathToOutput, []byte(text), 0755)
+	if err != nil {
+		return
+	}
+	if target.Revision != 0 {
+		log.Infof("restored '%s' to '%s' as of %s", filename, pathToOutput, time.Unix(0, target.Revision*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+	} else {
+		log.Infof("pulled '%s' to '%s'", filename, pathToOutput)
+	}
+	return
+}
@@ -0,0 +1,445 @@
+package patchitup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// A compressed patch is the base64 of the compressed patch text. Patches
+// compressed with anything other than gzip are prefixed with a header
+// naming the codec, e.g. "codec=zstd;dict=0123456789abcdef:". Patches
+// without a header are gzip, so older servers still understand them.
+
+// codec compresses and decompresses patches
+type codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// codecNames are the supported codecs, in order of preference
+var codecNames = []string{"zstd", "brotli", "gzip", "none"}
+
+// getCodec returns the codec with the name, using the dictionary with the
+// id for zstd if it is set.
+func getCodec(name, dictionaryID string) (c codec, err error) {
+	switch name {
+	case "gzip", "":
+		c = gzipCodec{}
+	case "zstd":
+		z := zstdCodec{dictionaryID: dictionaryID}
+		if dictionaryID != "" {
+			z.dictionary, err = loadDictionary(dictionaryID)
+		}
+		c = z
+	case "brotli":
+		c = brotliCodec{}
+	case "none":
+		c = noneCodec{}
+	default:
+		err = fmt.Errorf("unknown compression '%s'", name)
+	}
+	return
+}
+
+// compressPatchWith compresses the patch text, made with the diff
+// algorithm, with the codec.
+func compressPatchWith(patchUncompressed string, c codec, d differ) (compressedPatch string, err error) {
+	b, err := c.Compress([]byte(patchUncompressed))
+	if err != nil {
+		return
+	}
+	compressedPatch = base64.StdEncoding.EncodeToString(b)
+	if header := patchHeader(c, d); header != "" {
+		compressedPatch = header + ":" + compressedPatch
+	}
+	log.Debugf("compressed patch with %s from %s to %s", c.Name(), humanize.Bytes(uint64(len(patchUncompressed))), humanize.Bytes(uint64(len(compressedPatch))))
+	return
+}
+
+// patchHeader is the header identifying the codec and diff algorithm of
+// a compressed patch
+func patchHeader(c codec, d differ) string {
+	var fields []string
+	switch c := c.(type) {
+	case gzipCodec:
+	case zstdCodec:
+		fields = append(fields, "codec=zstd")
+		if c.dictionaryID != "" {
+			fields = append(fields, "dict="+c.dictionaryID)
+		}
+	default:
+		fields = append(fields, "codec="+c.Name())
+	}
+	if _, ok := d.(dmpDiffer); !ok {
+		if len(fields) == 0 {
+			fields = append(fields, "codec=gzip")
+		}
+		fields = append(fields, "diff="+d.Name())
+	}
+	return strings.Join(fields, ";")
+}
+
+// parsePatchHeader splits a compressed patch into its header fields and
+// its base64 body.
+func parsePatchHeader(compressedPatch string) (header map[string]string, body string) {
+	header = make(map[string]string)
+	body = compressedPatch
+	i := strings.Index(compressedPatch, ":")
+	if i < 0 {
+		return
+	}
+	body = compressedPatch[i+1:]
+	for _, field := range strings.Split(compressedPatch[:i], ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			header[kv[0]] = kv[1]
+		}
+	}
+	return
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// defaultMaxDecompressedSize is the most that data decompresses to when the
+// size of files is not limited
+const defaultMaxDecompressedSize = 1024 * 1024 * 1024
+
+// readDecompressed reads decompressed data up to a limit, so that a small
+// patch can not inflate to more than a file can be. Patches have the text
+// that they remove and add escaped, so they can be a few times larger than
+// the file.
+func readDecompressed(r io.Reader) ([]byte, error) {
+	max := int64(defaultMaxDecompressedSize)
+	if maxFileSize := getLimits().MaxFileSize; maxFileSize > 0 {
+		max = 4*maxFileSize + 1024*1024
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("decompressed data is larger than %s", humanize.Bytes(uint64(max)))
+	}
+	return data, nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return readDecompressed(gr)
+}
+
+type zstdCodec struct {
+	dictionaryID string
+	dictionary   []byte
+}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (z zstdCodec) Compress(data []byte) ([]byte, error) {
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBestCompression)}
+	if z.dictionary != nil {
+		opts = append(opts, zstd.WithEncoderDict(z.dictionary))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
+}
+
+func (z zstdCodec) Decompress(data []byte) ([]byte, error) {
+	var opts []zstd.DOption
+	if z.dictionary != nil {
+		opts = append(opts, zstd.WithDecoderDicts(z.dictionary))
+	}
+	dec, err := zstd.NewReader(bytes.NewReader(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return readDecompressed(dec)
+}
+
+type brotliCodec struct{}
+
+func (brotliCodec) Name() string { return "brotli" }
+
+func (brotliCodec) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := brotli.NewWriterLevel(&b, brotli.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (brotliCodec) Decompress(data []byte) ([]byte, error) {
+	return readDecompressed(brotli.NewReader(bytes.NewReader(data)))
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+
+func (noneCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+
+func (noneCodec) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+// Dictionaries are trained by the server from the contents of a file, and
+// kept forever since the revisions compressed with them depend on them.
+// Clients keep a copy of the dictionaries they use.
+
+const (
+	// minDictionaryTrainingSize is the smallest file a dictionary is trained for
+	minDictionaryTrainingSize = 64 * 1024
+	maxDictionarySize         = 64 * 1024
+	// dictionarySampleLines is the number of lines in each training sample
+	dictionarySampleLines = 16
+)
+
+func pathToServerDictionary(folder, id string) string {
+	return path.Join(folder, ".dicts", "ids", id)
+}
+
+// dictionaryFolders are the data folders of the routers, where the
+// dictionaries of their patches are
+var dictionaryFolders = struct {
+	sync.RWMutex
+	folders map[string]bool
+}{folders: make(map[string]bool)}
+
+func addDictionaryFolder(folder string) {
+	if folder == "" {
+		return
+	}
+	dictionaryFolders.Lock()
+	dictionaryFolders.folders[folder] = true
+	dictionaryFolders.Unlock()
+}
+
+func pathToClientDictionary(id string) string {
+	return path.Join(pathToCacheClient, "dicts", id)
+}
+
+// loadDictionary loads a dictionary from the data folders or the client
+// store.
+func loadDictionary(id string) (dictionary []byte, err error) {
+	if id == "" || strings.ContainsAny(id, `./\`) {
+		err = fmt.Errorf("invalid dictionary '%s'", id)
+		return
+	}
+	dictionaryFolders.RLock()
+	for folder := range dictionaryFolders.folders {
+		dictionary, err = ioutil.ReadFile(pathToServerDictionary(folder, id))
+		if err == nil {
+			dictionaryFolders.RUnlock()
+			return
+		}
+	}
+	dictionaryFolders.RUnlock()
+	dictionary, err = ioutil.ReadFile(pathToClientDictionary(id))
+	if err != nil {
+		err = fmt.Errorf("dictionary '%s' not found", id)
+	}
+	return
+}
+
+// trainDictionary trains a zstd dictionary on the lines of a text.
+func trainDictionary(text string) (dictionary []byte, id string, err error) {
+	if len(text) < minDictionaryTrainingSize {
+		err = fmt.Errorf("%s is too small to train a dictionary", humanize.Bytes(uint64(len(text))))
+		return
+	}
+	lines := strings.SplitAfter(text, "\n")
+	var samples [][]byte
+	for i := 0; i < len(lines); i += dictionarySampleLines {
+		end := i + dictionarySampleLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		samples = append(samples, []byte(strings.Join(lines[i:end], "")))
+	}
+	dictionary, err = dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxDictionarySize,
+		HashBytes:   6,
+	})
+	if err != nil {
+		return
+	}
+	id = checksum(dictionary)[:16]
+	return
+}
+
+// saveDictionary stores a dictionary at the path, if it is not there yet.
+func saveDictionary(pathToDictionary string, dictionary []byte) (err error) {
+	if Exists(pathToDictionary) {
+		return
+	}
+	os.MkdirAll(path.Dir(pathToDictionary), 0755)
+	return ioutil.WriteFile(pathToDictionary, dictionary, 0755)
+}
+
+func handlerDictionary(c *gin.Context) {
+	id, data, message, err := func(c *gin.Context) (id string, data []byte, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
+		// use the dictionary of the file, or train one
+		pathToFileDictionary := path.Join(dataDir(c), ".dicts", "files", sr.Username, sr.Filename)
+		if bID, errRead := ioutil.ReadFile(pathToFileDictionary); errRead == nil {
+			id = string(bID)
+			data, err = loadDictionary(id)
+		} else {
+			var text string
+			text, err = getFileText(pathToFile)
+			if err != nil {
+				return
+			}
+			data, id, err = trainDictionary(text)
+			if err != nil {
+				// not an error, the client just compresses without a dictionary
+				message = err.Error()
+				err = nil
+				return
+			}
+			log.Infof("%s/%s trained dictionary %s (%s)", sr.Username, sr.Filename, id, humanize.Bytes(uint64(len(data))))
+			err = saveDictionary(pathToServerDictionary(dataDir(c), id), data)
+			if err != nil {
+				return
+			}
+			os.MkdirAll(path.Dir(pathToFileDictionary), 0755)
+			err = ioutil.WriteFile(pathToFileDictionary, []byte(id), 0755)
+		}
+		if err != nil {
+			return
+		}
+		message = "dictionary " + id
+		// the client already has it
+		if sr.DictionaryID == id {
+			data = nil
+		}
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:      message,
+		Success:      err == nil,
+		DictionaryID: id,
+		Data:         base64String(base64.StdEncoding.EncodeToString(data)),
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// getDictionary returns the dictionary of a file from the server, which is
+// only downloaded if it is not the one the client already has.
+func getDictionary(address, username, filename string) (id string, err error) {
+	pathToDictionaryID := pathToClientDictionary(queueKey(address, username, filename) + ".id")
+	knownID, _ := ioutil.ReadFile(pathToDictionaryID)
+	target, err := postToServerRetry(address+"/dictionary", serverRequest{
+		Username:     username,
+		Filename:     filename,
+		DictionaryID: string(knownID),
+	})
+	if err != nil {
+		return
+	}
+	if target.DictionaryID == "" {
+		err = errors.New(target.Message)
+		return
+	}
+	id = target.DictionaryID
+	if id != string(knownID) || !Exists(pathToClientDictionary(id)) {
+		var dictionary []byte
+		dictionary, err = base64.StdEncoding.DecodeString(string(target.Data))
+		if err != nil {
+			return
+		}
+		if len(dictionary) == 0 {
+			err = fmt.Errorf("dictionary %s missing", id)
+			return
+		}
+		err = saveDictionary(pathToClientDictionary(id), dictionary)
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(pathToDictionaryID, []byte(id), 0755)
+	}
+	return
+}
+
+// getPatchCodec returns the codec to compress patches with, which is the
+// preferred compression (zstd by default) if the server supports it, and
+// otherwise gzip.
+func getPatchCodec(address, username, filename string, caps capabilities, preference string) codec {
+	if preference == "" {
+		preference = "zstd"
+	}
+	if !contains(caps.Compression, preference) {
+		log.Debugf("server does not support %s, using gzip", preference)
+		return gzipCodec{}
+	}
+	if preference == "zstd" && contains(caps.Features, featureDictionary) {
+		id, err := getDictionary(address, username, filename)
+		if err == nil {
+			var c codec
+			c, err = getCodec("zstd", id)
+			if err == nil {
+				return c
+			}
+		}
+		log.Debugf("not using a dictionary: %s", err)
+	}
+	c, err := getCodec(preference, "")
+	if err != nil {
+		return gzipCodec{}
+	}
+	return c
+}
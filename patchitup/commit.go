@@ -0,0 +1,449 @@
+package patchitup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// A commit patches several files of a user at once, and either every patch
+// is applied or none are. The revisions of a commit all have the same
+// number, and the commit is recorded in .commits/<user>/<id>.json so that
+// the files can be restored together.
+
+// commitFile is the patch of one file of a commit
+type commitFile struct {
+	Filename string       `json:"filename"`
+	Patch    base64String `json:"patch"`
+}
+
+// CommitInfo describes a commit of several files.
+type CommitInfo struct {
+	ID       string   `json:"id"`
+	Revision int64    `json:"revision"`
+	Message  string   `json:"message,omitempty"`
+	Files    []string `json:"files"`
+}
+
+// userLocks makes sure that only one change is made to the files of a user
+// at a time
+var userLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// lockUser locks the files of the user until unlock is called.
+func lockUser(username string) (unlock func()) {
+	userLocks.Lock()
+	l, ok := userLocks.m[username]
+	if !ok {
+		l = new(sync.Mutex)
+		userLocks.m[username] = l
+	}
+	userLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func pathToCommits(folder, username string) string {
+	return path.Join(folder, ".commits", username)
+}
+
+// applyCommit applies the patches of every file in the data folder, or none
+// of them.
+func applyCommit(folder, username, message string, files []commitFile) (commit CommitInfo, err error) {
+	if len(files) == 0 {
+		err = errors.New("no files in commit")
+		return
+	}
+	err = validateNames(username)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		err = validateNames(f.Filename)
+		if err != nil {
+			return
+		}
+		if _, ok := seen[f.Filename]; ok {
+			err = fmt.Errorf("'%s' is in the commit twice", f.Filename)
+			return
+		}
+		seen[f.Filename] = struct{}{}
+	}
+
+	unlock := lockUser(username)
+	defer unlock()
+	return commitLocked(folder, username, message, files)
+}
+
+// commitLocked applies the patches of a commit to the files of a user that
+// is locked.
+func commitLocked(folder, username, message string, files []commitFile) (commit CommitInfo, err error) {
+	os.MkdirAll(path.Join(folder, username), 0755)
+
+	// apply every patch before changing any file
+	staged := make([]string, len(files))
+	baseHashes := make([]string, len(files))
+	defer func() {
+		for _, pathToTemp := range staged {
+			os.Remove(pathToTemp)
+		}
+	}()
+	revision := time.Now().UnixNano() / 1000000
+	for i, f := range files {
+		pathToFile := path.Join(folder, username, f.Filename)
+		baseHashes[i] = textHash(pathToFile)
+		var newText string
+		newText, err = getPatchedText(pathToFile, string(f.Patch))
+		if err != nil {
+			err = errors.Wrapf(err, "problem patching '%s'", f.Filename)
+			return
+		}
+		staged[i], err = stagePatchedText(pathToFile, newText)
+		if err != nil {
+			return
+		}
+		// the revision of the commit must be the latest of every file
+		revisions, _ := listRevisions(pathToFile)
+		if len(revisions) > 0 && revisions[len(revisions)-1] >= revision {
+			revision = revisions[len(revisions)-1] + 1
+		}
+	}
+
+	// keep the original files until the commit is recorded, and put them
+	// back if any part of it fails
+	originals := make([]string, len(files))
+	replaced := 0
+	defer func() {
+		if err != nil {
+			for i := replaced - 1; i >= 0; i-- {
+				errRollback := rollbackPatchedText(path.Join(folder, username, files[i].Filename), originals[i], revision)
+				if errRollback != nil {
+					log.Errorf("problem rolling back '%s': %s", files[i].Filename, errRollback)
+				}
+			}
+		}
+		for _, pathToOriginal := range originals {
+			if pathToOriginal != "" {
+				os.Remove(pathToOriginal)
+			}
+		}
+	}()
+	for i, f := range files {
+		originals[i], err = keepOriginal(path.Join(folder, username, f.Filename))
+		if err != nil {
+			return
+		}
+	}
+
+	commit = CommitInfo{
+		Revision: revision,
+		Message:  message,
+	}
+	for i, f := range files {
+		replaced = i + 1
+		err = commitPatchedText(path.Join(folder, username, f.Filename), staged[i], string(f.Patch), revision)
+		if err != nil {
+			err = errors.Wrapf(err, "problem committing '%s'", f.Filename)
+			return
+		}
+		commit.Files = append(commit.Files, f.Filename)
+	}
+	commit.ID = checksum([]byte(fmt.Sprintf("%s/%d/%s", username, revision, strings.Join(commit.Files, "/"))))[:16]
+	bCommit, err := json.Marshal(commit)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(pathToCommits(folder, username), 0755)
+	err = ioutil.WriteFile(path.Join(pathToCommits(folder, username), commit.ID+".json"), bCommit, 0755)
+	if err != nil {
+		return
+	}
+
+	// the commit is only published once it is recorded
+	for i, f := range files {
+		publishPatch(username, f.Filename, path.Join(folder, username, f.Filename), baseHashes[i], len(f.Patch))
+	}
+	return
+}
+
+// listCommits returns the commits of a user in order, or only the commits
+// that include the file if it is set.
+func listCommits(folder, username, filename string) (commits []CommitInfo, err error) {
+	err = validateNames(username)
+	if err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(pathToCommits(folder, username))
+	if err != nil {
+		// no commits
+		err = nil
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		bCommit, errRead := ioutil.ReadFile(path.Join(pathToCommits(folder, username), f.Name()))
+		if errRead != nil {
+			continue
+		}
+		var commit CommitInfo
+		if json.Unmarshal(bCommit, &commit) != nil {
+			continue
+		}
+		if filename != "" && !contains(commit.Files, filename) {
+			continue
+		}
+		commits = append(commits, commit)
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i].Revision < commits[j].Revision })
+	return
+}
+
+// removeFromCommits removes a deleted file from the commits of a user, and
+// the commits that have no other files.
+func removeFromCommits(folder, username, filename string) (err error) {
+	commits, err := listCommits(folder, username, filename)
+	if err != nil {
+		return
+	}
+	for _, commit := range commits {
+		pathToCommit := path.Join(pathToCommits(folder, username), commit.ID+".json")
+		var files []string
+		for _, f := range commit.Files {
+			if f != filename {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			err = os.Remove(pathToCommit)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		commit.Files = files
+		var bCommit []byte
+		bCommit, err = json.Marshal(commit)
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(pathToCommit, bCommit, 0755)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func handlerCommit(c *gin.Context) {
+	commit, message, err := func(c *gin.Context) (commit CommitInfo, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s commit upload: %s", sr.Username, humanize.Bytes(uint64(c.Request.ContentLength)))
+		commit, err = applyCommit(dataDir(c), sr.Username, sr.Message, sr.Files)
+		if err != nil {
+			return
+		}
+		message = fmt.Sprintf("committed %d files as %s", len(commit.Files), commit.ID)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:  message,
+		Success:  err == nil,
+		Commit:   commit.ID,
+		Revision: commit.Revision,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+func handlerCommits(c *gin.Context) {
+	commits, message, err := func(c *gin.Context) (commits []CommitInfo, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		commits, err = listCommits(dataDir(c), sr.Username, sr.Filename)
+		message = fmt.Sprintf("%d commits", len(commits))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+		Commits: commits,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// CommitFiles uploads the changes to several files as one commit, so that
+// either all of them are applied on the server or none are. It returns the
+// ID of the commit, which is empty if every file was up-to-date.
+func CommitFiles(address, username string, pathsToFiles []string, message string, opts Options) (id string, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	address, username = c.ServerAddress, c.Username
+	if opts.Compression == "" {
+		opts.Compression = c.Compression
+	}
+	opts.diffAlgorithms = c.DiffAlgorithms
+	err = requireFeature(address, featureCommit)
+	if err != nil {
+		return
+	}
+	caps, err := getCapabilities(address)
+	if err != nil {
+		return
+	}
+
+	resetBandwidth(address, username)
+	var patches []preparedPatch
+	sr := serverRequest{
+		Username: username,
+		Message:  message,
+	}
+	for _, pathToFile := range pathsToFiles {
+		_, filename := filepath.Split(pathToFile)
+		s, errSnapshot := takeSnapshot(pathToFile)
+		if errSnapshot != nil {
+			err = errSnapshot
+			return
+		}
+		p, errPrepare := preparePatch(address, username, s, filename, caps, opts)
+		s.remove()
+		if errPrepare != nil {
+			err = errors.Wrapf(errPrepare, "problem preparing '%s'", filename)
+			return
+		}
+		if p.upToDate {
+			continue
+		}
+		if opts.DryRun {
+			p.report(pathToFile, username, opts)
+			continue
+		}
+		patches = append(patches, p)
+		sr.Files = append(sr.Files, commitFile{
+			Filename: filename,
+			Patch:    base64String(p.patch),
+		})
+	}
+	if len(patches) == 0 {
+		return
+	}
+
+	target, err := postToServer(address+"/commit", sr)
+	if err != nil {
+		return
+	}
+	id = target.Commit
+	transferred, _ := getBandwidth(address, username)
+	log.Infof("committed %d files as %s (transferred %s)", len(patches), id, humanize.Bytes(uint64(transferred)))
+	for _, p := range patches {
+		err = p.updateRemoteCopy()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ListCommits returns the commits of the user on the server, or only the
+// commits that include the file if pathToFile is set.
+func ListCommits(address, username, pathToFile string) (commits []CommitInfo, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureCommit)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	target, err := postToServerRetry(c.ServerAddress+"/commits", serverRequest{
+		Username: c.Username,
+		Filename: filename,
+	})
+	commits = target.Commits
+	return
+}
+
+// PullCommit restores every file of a commit into the folder (by default
+// the current directory). Nothing is written unless every file could be
+// restored.
+func PullCommit(address, username, id, folder string) (err error) {
+	defer log.Flush()
+	commits, err := ListCommits(address, username, "")
+	if err != nil {
+		return
+	}
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	var commit CommitInfo
+	for _, ci := range commits {
+		if strings.HasPrefix(ci.ID, id) && id != "" {
+			commit = ci
+		}
+	}
+	if commit.ID == "" {
+		return fmt.Errorf("commit '%s' not found", id)
+	}
+
+	texts := make([]string, len(commit.Files))
+	for i, filename := range commit.Files {
+		target, errRestore := postToServerRetry(c.ServerAddress+"/restore", serverRequest{
+			Username: c.Username,
+			Filename: filename,
+			At:       fmt.Sprint(commit.Revision),
+		})
+		if errRestore != nil {
+			return errors.Wrapf(errRestore, "problem restoring '%s'", filename)
+		}
+		texts[i], err = decompressPatch(string(target.Data))
+		if err != nil {
+			return
+		}
+	}
+	if folder == "" {
+		folder = "."
+	}
+	os.MkdirAll(folder, 0755)
+	for i, filename := range commit.Files {
+		err = ioutil.WriteFile(path.Join(folder, filename), []byte(texts[i]), 0755)
+		if err != nil {
+			return
+		}
+	}
+	log.Infof("restored %d files of commit %s to '%s'", len(commit.Files), commit.ID, folder)
+	return
+}
@@ -0,0 +1,254 @@
+package patchitup
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each hunk
+const diffContextLines = 3
+
+// diffHunk is a single hunk of a unified diff
+type diffHunk struct {
+	FromLine  int `json:"from_line"`
+	FromCount int `json:"from_count"`
+	ToLine    int `json:"to_line"`
+	ToCount   int `json:"to_count"`
+	// Lines are prefixed with ' ' (unchanged), '-' (removed) or '+' (added)
+	Lines []string `json:"lines"`
+}
+
+// lineOp is a single line of a line-based diff
+type lineOp struct {
+	op   byte // ' ' (unchanged), '-' (removed) or '+' (added)
+	text string
+	// noNewline is set for the last line of a file without a trailing newline
+	noNewline bool
+}
+
+// diffMaxCost limits the number of edits searched for at once before
+// giving up on finding a minimal diff for a block of lines
+const diffMaxCost = 4096
+
+// diffLines computes a line-based diff between text1 and text2 using the
+// Myers algorithm on the lines.
+func diffLines(text1, text2 string) (ops []lineOp) {
+	lines1, lines2 := splitLines(text1), splitLines(text2)
+	// number each unique line so that lines can be compared as integers
+	ids := make(map[string]int)
+	toIDs := func(lines []string) []int {
+		a := make([]int, len(lines))
+		for i, line := range lines {
+			if _, ok := ids[line]; !ok {
+				ids[line] = len(ids)
+			}
+			a[i] = ids[line]
+		}
+		return a
+	}
+	a, b := toIDs(lines1), toIDs(lines2)
+
+	add := func(op byte, line string) {
+		ops = append(ops, lineOp{
+			op:        op,
+			text:      strings.TrimSuffix(line, "\n"),
+			noNewline: !strings.HasSuffix(line, "\n"),
+		})
+	}
+	var walk func(x0, x1, y0, y1 int)
+	walk = func(x0, x1, y0, y1 int) {
+		// common prefix
+		for x0 < x1 && y0 < y1 && a[x0] == b[y0] {
+			add(' ', lines1[x0])
+			x0++
+			y0++
+		}
+		// common suffix
+		x2, y2 := x1, y1
+		for x2 > x0 && y2 > y0 && a[x2-1] == b[y2-1] {
+			x2--
+			y2--
+		}
+		x, y, u, v, ok := middleSnake(a[x0:x2], b[y0:y2])
+		if x0 == x2 || y0 == y2 || !ok {
+			for i := x0; i < x2; i++ {
+				add('-', lines1[i])
+			}
+			for i := y0; i < y2; i++ {
+				add('+', lines2[i])
+			}
+		} else {
+			walk(x0, x0+x, y0, y0+y)
+			for i := x0 + x; i < x0+u; i++ {
+				add(' ', lines1[i])
+			}
+			walk(x0+u, x2, y0+v, y2)
+		}
+		for i := x2; i < x1; i++ {
+			add(' ', lines1[i])
+		}
+	}
+	walk(0, len(a), 0, len(b))
+	return
+}
+
+// splitLines splits text into lines, keeping the line endings.
+func splitLines(text string) (lines []string) {
+	lines = strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return
+}
+
+// middleSnake finds the middle snake of the shortest edit script between
+// a and b, returning its start (x, y) and end (u, v). It returns false if
+// a and b differ by more than diffMaxCost edits.
+func middleSnake(a, b []int) (x, y, u, v int, ok bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return
+	}
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1
+	// vf holds the furthest x reached going forward on each diagonal
+	// and vb the furthest distance from the end going backward
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+	for d := 0; d <= max && d <= diffMaxCost; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			vf[offset+k] = u
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && u+vb[offset+c] >= n {
+				ok = true
+				return
+			}
+		}
+		for c := -d; c <= d; c += 2 {
+			var xr int
+			if c == -d || (c != d && vb[offset+c-1] < vb[offset+c+1]) {
+				xr = vb[offset+c+1]
+			} else {
+				xr = vb[offset+c-1] + 1
+			}
+			yr := xr - c
+			ur, vr := xr, yr
+			for ur < n && vr < m && a[n-ur-1] == b[m-vr-1] {
+				ur++
+				vr++
+			}
+			vb[offset+c] = ur
+			if k := delta - c; !odd && k >= -d && k <= d && vf[offset+k]+ur >= n {
+				x, y, u, v = n-ur, m-vr, n-xr, m-yr
+				ok = true
+				return
+			}
+		}
+	}
+	return
+}
+
+// getHunks groups a line-based diff into hunks with the given number of
+// context lines.
+func getHunks(ops []lineOp, context int) (hunks []diffHunk) {
+	// determine the line number in each file before every op
+	fromLines := make([]int, len(ops)+1)
+	toLines := make([]int, len(ops)+1)
+	for i, o := range ops {
+		fromLines[i+1] = fromLines[i]
+		toLines[i+1] = toLines[i]
+		if o.op != '+' {
+			fromLines[i+1]++
+		}
+		if o.op != '-' {
+			toLines[i+1]++
+		}
+	}
+
+	i := 0
+	for i < len(ops) {
+		if ops[i].op == ' ' {
+			i++
+			continue
+		}
+		// find the end of this hunk, merging changes that are close together
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].op != ' ' {
+				end = j
+			} else if j-end > 2*context {
+				break
+			}
+		}
+		stop := end + context + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		h := diffHunk{
+			FromLine: fromLines[start] + 1,
+			ToLine:   toLines[start] + 1,
+		}
+		for _, o := range ops[start:stop] {
+			switch o.op {
+			case '-':
+				h.FromCount++
+			case '+':
+				h.ToCount++
+			default:
+				h.FromCount++
+				h.ToCount++
+			}
+			h.Lines = append(h.Lines, string(o.op)+o.text)
+			if o.noNewline {
+				h.Lines = append(h.Lines, `\ No newline at end of file`)
+			}
+		}
+		// an empty range is referred to by the line before it
+		if h.FromCount == 0 {
+			h.FromLine--
+		}
+		if h.ToCount == 0 {
+			h.ToLine--
+		}
+		hunks = append(hunks, h)
+		i = stop
+	}
+	return
+}
+
+// unifiedDiff returns the unified diff between text1 and text2 along with
+// the hunks that make it up.
+func unifiedDiff(fromName, toName, text1, text2 string) (diff string, hunks []diffHunk) {
+	hunks = getHunks(diffLines(text1, text2), diffContextLines)
+	if len(hunks) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", fromName, toName)
+	for _, h := range hunks {
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", h.FromLine, h.FromCount, h.ToLine, h.ToCount)
+		for _, line := range h.Lines {
+			buf.WriteString(line + "\n")
+		}
+	}
+	diff = buf.String()
+	return
+}
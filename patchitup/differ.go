@@ -0,0 +1,165 @@
+package patchitup
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Patches are made with either diffmatchpatch, which diffs characters, or
+// as standard unified diffs of lines, which are faster for large files and
+// can be read and applied with standard tools. Patches that are not
+// diffmatchpatch name their diff algorithm in the patch header, e.g.
+// "codec=zstd;diff=unified:".
+
+// differ makes and applies patches
+type differ interface {
+	Name() string
+	// Diff returns the patch that turns text1 into text2
+	Diff(filename, text1, text2 string) string
+	// Apply applies the patch to text
+	Apply(text, patch string) (string, error)
+}
+
+// diffNames are the supported diff algorithms
+var diffNames = []string{"diffmatchpatch", "unified"}
+
+// unifiedDiffSize is the size above which files are diffed by line when no
+// diff algorithm is chosen, since diffing characters is slow for them
+const unifiedDiffSize = 512 * 1024
+
+// getDiffer returns the diff algorithm with the name.
+func getDiffer(name string) (d differ, err error) {
+	switch name {
+	case "diffmatchpatch", "":
+		d = dmpDiffer{}
+	case "unified":
+		d = unifiedDiffer{}
+	default:
+		err = fmt.Errorf("unknown diff algorithm '%s'", name)
+	}
+	return
+}
+
+// chooseDiffer returns the diff algorithm for a file, which is the
+// preference, or the algorithm of the first pattern (in sorted order) that
+// matches the filename, or otherwise unified for large files. Servers that
+// do not support unified diffs always get diffmatchpatch.
+func chooseDiffer(filename string, size int, preference string, algorithms map[string]string, caps capabilities) differ {
+	if preference == "" {
+		patterns := make([]string, 0, len(algorithms))
+		for pattern := range algorithms {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, filename); ok {
+				preference = algorithms[pattern]
+				break
+			}
+		}
+	}
+	if preference == "" && size > unifiedDiffSize {
+		preference = "unified"
+	}
+	d, err := getDiffer(preference)
+	if err != nil || !contains(caps.Diff, d.Name()) {
+		return dmpDiffer{}
+	}
+	return d
+}
+
+type dmpDiffer struct{}
+
+func (dmpDiffer) Name() string { return "diffmatchpatch" }
+
+func (dmpDiffer) Diff(filename, text1, text2 string) string {
+	return getPatchText(text1, text2)
+}
+
+func (dmpDiffer) Apply(text, patch string) (string, error) {
+	return applyPatch(text, patch)
+}
+
+type unifiedDiffer struct{}
+
+func (unifiedDiffer) Name() string { return "unified" }
+
+func (unifiedDiffer) Diff(filename, text1, text2 string) string {
+	diff, _ := unifiedDiff("a/"+filename, "b/"+filename, text1, text2)
+	return diff
+}
+
+func (unifiedDiffer) Apply(text, patch string) (string, error) {
+	return applyUnifiedDiff(text, patch)
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// applyUnifiedDiff applies a unified diff to text. Unlike diffmatchpatch
+// patches, the unchanged and removed lines must match exactly.
+func applyUnifiedDiff(text, diff string) (newText string, err error) {
+	lines := splitLines(text)
+	var out []string
+	pos := 0
+	inHunk := false
+	var last byte
+	for n, line := range splitLines(diff) {
+		line = strings.TrimSuffix(line, "\n")
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			// an empty range refers to the line before it
+			if count > 0 {
+				start--
+			}
+			if start < pos || start > len(lines) {
+				err = fmt.Errorf("hunk at line %d is out of range", n+1)
+				return
+			}
+			out = append(out, lines[pos:start]...)
+			pos = start
+			inHunk = true
+			continue
+		}
+		if !inHunk {
+			// the file names before the first hunk
+			continue
+		}
+		if line == "" {
+			err = fmt.Errorf("malformed line %d", n+1)
+			return
+		}
+		switch line[0] {
+		case ' ', '-':
+			if pos >= len(lines) || strings.TrimSuffix(lines[pos], "\n") != line[1:] {
+				err = fmt.Errorf("line %d of the patch does not match", n+1)
+				return
+			}
+			if line[0] == ' ' {
+				out = append(out, lines[pos])
+			}
+			pos++
+		case '+':
+			out = append(out, line[1:]+"\n")
+		case '\\':
+			// "\ No newline at end of file" after an added line
+			if last == '+' {
+				out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
+			}
+		default:
+			err = fmt.Errorf("malformed line %d", n+1)
+			return
+		}
+		last = line[0]
+	}
+	out = append(out, lines[pos:]...)
+	newText = strings.Join(out, "")
+	return
+}
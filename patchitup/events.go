@@ -0,0 +1,287 @@
+package patchitup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Changes to files are published as events, which clients can subscribe to
+// with GET /events?username=<user> as a stream of server-sent events.
+
+// Types of events
+const (
+	EventPatch   = "patch"
+	EventCreate  = "create"
+	EventDelete  = "delete"
+	EventRestore = "restore"
+)
+
+// Event is a change to a file on the server.
+type Event struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Filename string `json:"filename"`
+	// Hash is the hash of the file after the change
+	Hash string `json:"hash,omitempty"`
+	// Size is the size of the patch
+	Size     int   `json:"size,omitempty"`
+	Revision int64 `json:"revision,omitempty"`
+	// Time is when the event happened, in unix milliseconds
+	Time int64 `json:"time"`
+	// dataDir is the data folder of the file
+	dataDir string
+	// baseHash and textHash are the hashes of the text of the file before
+	// and after the change (see md5Text), which secondary servers check
+	baseHash string
+	textHash string
+}
+
+// eventKeepAlive is how often a comment is sent to idle subscribers so that
+// proxies do not close the connection
+const eventKeepAlive = 15 * time.Second
+
+// eventBuffer is the number of events buffered for a slow subscriber before
+// events are dropped
+const eventBuffer = 64
+
+// broker sends the published events to the subscribers of each user
+type broker struct {
+	sync.Mutex
+	subscribers map[chan Event]subscription
+}
+
+// subscription is the data folder and user whose events a subscriber gets
+type subscription struct {
+	dataDir, username string
+}
+
+var events = &broker{subscribers: make(map[chan Event]subscription)}
+
+// subscribe returns the events of the user in the data folder, or of every
+// user if username is empty.
+func (b *broker) subscribe(dataDir, username string) chan Event {
+	ch := make(chan Event, eventBuffer)
+	b.Lock()
+	b.subscribers[ch] = subscription{dataDir, username}
+	b.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan Event) {
+	b.Lock()
+	delete(b.subscribers, ch)
+	b.Unlock()
+}
+
+// publish sends the event to the subscribers of its user (and those of
+// every user), without waiting for subscribers that are not keeping up.
+func (b *broker) publish(e Event) {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixNano() / 1000000
+	}
+	b.Lock()
+	defer b.Unlock()
+	for ch, s := range b.subscribers {
+		if s.dataDir != e.dataDir || (s.username != "" && s.username != e.Username) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("dropping %s event of %s/%s for a slow subscriber", e.Type, e.Username, e.Filename)
+		}
+	}
+}
+
+// publishPatch publishes that a patch of the size was applied to a file
+// with the base hash, which created it if it is the first revision.
+func publishPatch(username, filename, pathToFile, baseHash string, size int) {
+	e := Event{
+		Type:     EventPatch,
+		Username: username,
+		Filename: filename,
+		Size:     size,
+		dataDir:  path.Dir(path.Dir(pathToFile)),
+		baseHash: baseHash,
+		textHash: textHash(pathToFile),
+	}
+	revisions, _ := listRevisions(pathToFile)
+	if len(revisions) > 0 {
+		e.Revision = revisions[len(revisions)-1]
+	}
+	if len(revisions) == 1 {
+		e.Type = EventCreate
+	}
+	e.Hash, _ = Filemd5Sum(pathToFile)
+	events.publish(e)
+}
+
+func handlerEvents(c *gin.Context) {
+	username := c.Query("username")
+	if err := validateNames(username); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := authorizeUser(c, username); err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	log.Infof("%s subscribed to events", username)
+	ch := events.subscribe(dataDir(c), username)
+	defer events.unsubscribe(ch)
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-ch:
+			c.SSEvent(e.Type, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ":\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+	log.Infof("%s unsubscribed from events", username)
+}
+
+func handlerDelete(c *gin.Context) {
+	message, err := func(c *gin.Context) (message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		unlock := lockUser(sr.Username)
+		defer unlock()
+		revisions, err := listRevisions(pathToFile)
+		if err != nil {
+			return
+		}
+		err = os.Remove(pathToFile)
+		if err != nil {
+			return
+		}
+		for _, r := range revisions {
+			os.Remove(pathToRevision(pathToFile, r))
+		}
+		os.Remove(pathToTags(pathToFile))
+		os.RemoveAll(path.Join(dataDir(c), ".dicts", "files", sr.Username, sr.Filename))
+		err = removeFromCommits(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s deleted with %d revisions", sr.Username, sr.Filename, len(revisions))
+		events.publish(Event{
+			Type:     EventDelete,
+			Username: sr.Username,
+			Filename: sr.Filename,
+			dataDir:  dataDir(c),
+		})
+		message = fmt.Sprintf("deleted '%s'", sr.Filename)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// Delete deletes a file and all of its revisions from the server.
+func Delete(address, username, pathToFile string) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureDelete)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	_, err = postToServer(c.ServerAddress+"/delete", serverRequest{
+		Username: c.Username,
+		Filename: filename,
+	})
+	if err != nil {
+		return
+	}
+	os.Remove(pathToCachedCopy(c.ServerAddress, c.Username, filename))
+	log.Infof("deleted '%s' from the server", filename)
+	return
+}
+
+// Subscribe sends the events of the user on the server to the channel
+// until the connection is closed.
+func Subscribe(address, username string, ch chan<- Event) (err error) {
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureEvents)
+	if err != nil {
+		return
+	}
+	if _, ok := getTransport(c.ServerAddress).(localTransport); ok {
+		return errors.New("events are not supported for local directories")
+	}
+	// the stream is open for as long as the server keeps it open
+	client := &http.Client{Transport: httpClient.Transport}
+	req, err := http.NewRequest("GET", c.ServerAddress+"/events?username="+url.QueryEscape(c.Username), nil)
+	if err != nil {
+		return
+	}
+	err = signRequest(req, c.Username, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return unreachableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s/events: %s", c.ServerAddress, resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var e Event
+		err = json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &e)
+		if err != nil {
+			return errors.Wrap(err, "malformed event")
+		}
+		ch <- e
+	}
+	return scanner.Err()
+}
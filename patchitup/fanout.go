@@ -0,0 +1,130 @@
+package patchitup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// Policies of PatchUpTo, which determine whether uploading to several
+// destinations succeeded
+const (
+	// PolicyAll needs every destination to succeed
+	PolicyAll = "all"
+	// PolicyAny needs at least one destination to succeed
+	PolicyAny = "any"
+	// PolicyQuorum needs a majority of the destinations to succeed
+	PolicyQuorum = "quorum"
+)
+
+// Destination is a server to upload to, given by a profile of the
+// configuration or by its address and username.
+type Destination struct {
+	Profile       string
+	ServerAddress string
+	Username      string
+}
+
+// DestinationResult is the result of uploading to a destination, with its
+// address and username as configured.
+type DestinationResult struct {
+	Destination
+	Err error
+}
+
+// PatchUpTo uploads the file to every destination in parallel. The file is
+// read and hashed once, and each destination patches from its own cached
+// copy of the file. Destinations that can not be reached are queued. It
+// returns an error unless enough destinations succeeded for the policy
+// (all by default).
+func PatchUpTo(destinations []Destination, pathToFile, policy string, opts Options) (results []DestinationResult, err error) {
+	defer log.Flush()
+	if len(destinations) == 0 {
+		err = errors.New("no destinations")
+		return
+	}
+	needed := len(destinations)
+	switch policy {
+	case PolicyAll, "":
+		policy = PolicyAll
+	case PolicyAny:
+		needed = 1
+	case PolicyQuorum:
+		needed = len(destinations)/2 + 1
+	default:
+		err = fmt.Errorf("unknown policy '%s'", policy)
+		return
+	}
+	os.MkdirAll(path.Join(UserHomeDir(), ".patchitup", "client"), 0755)
+
+	// the configurations are handled one at a time since they are saved
+	configs := make([]clientConfiguration, len(destinations))
+	results = make([]DestinationResult, len(destinations))
+	for i, d := range destinations {
+		configs[i], err = handleProfileConfiguration(d.Profile, d.ServerAddress, d.Username)
+		if err != nil {
+			return
+		}
+		results[i].Destination = Destination{
+			Profile:       d.Profile,
+			ServerAddress: configs[i].ServerAddress,
+			Username:      configs[i].Username,
+		}
+	}
+	_, filename := filepath.Split(pathToFile)
+
+	if !opts.DryRun {
+		for _, c := range configs {
+			removeFromQueue(c.ServerAddress, c.Username, filename)
+		}
+		err = flushQueue(opts)
+		if err != nil {
+			log.Warnf("server still unreachable: %s", err)
+		}
+	}
+
+	s, err := takeSnapshot(pathToFile)
+	if err != nil {
+		return
+	}
+	defer s.remove()
+	var wg sync.WaitGroup
+	for i := range configs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, o := configs[i], opts
+			if o.Compression == "" {
+				o.Compression = c.Compression
+			}
+			o.diffAlgorithms = c.DiffAlgorithms
+			results[i].Err = patchUpSnapshot(c.ServerAddress, c.Username, s, filename, o)
+			if isUnreachable(results[i].Err) && !opts.DryRun {
+				log.Warnf("%s unreachable, will upload '%s' next time: %s", c.ServerAddress, filename, results[i].Err)
+				if errQueue := addToQueue(c.ServerAddress, c.Username, s.pathToCopy, filename, opts); errQueue != nil {
+					log.Warn(errQueue)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, r := range results {
+		if r.Err != nil {
+			log.Warnf("%s: %s", r.ServerAddress, r.Err)
+			continue
+		}
+		log.Infof("%s: up-to-date", r.ServerAddress)
+		succeeded++
+	}
+	if succeeded < needed {
+		err = fmt.Errorf("uploaded '%s' to %d of %d destinations, but %s needs %d", filename, succeeded, len(destinations), policy, needed)
+	}
+	return
+}
@@ -0,0 +1,358 @@
+package patchitup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// The server limits the size of requests and of files, and how often each
+// user and each address can make requests, as configured in .limits.toml in
+// the server folder, like
+//
+//   MaxBodySize = 33554432
+//   MaxFileSize = 104857600
+//   UserRate = 10
+//   UserBurst = 50
+//
+//   [MaxBodySizes]
+//   "/bundle" = 134217728
+//
+// Requests that are too large are refused with 413, and requests over the
+// rate with 429 and a Retry-After header. Clients upload patches that are
+// too large in chunks, and wait before trying again when they are limited.
+
+// defaultMaxBodySize is the size of the largest request body, unless
+// configured
+const defaultMaxBodySize = 32 * 1024 * 1024
+
+// requestUserKey is the key of the user that a request is made for in the
+// context of the request
+const requestUserKey = "requestUser"
+
+// maxRetryAfter is the longest that a client waits when it is limited
+const maxRetryAfter = time.Minute
+
+// limitsConfiguration are the limits of the server
+type limitsConfiguration struct {
+	// MaxBodySize is the size of the largest request body, in bytes
+	MaxBodySize int64
+	// MaxBodySizes override MaxBodySize for endpoints, e.g. "/bundle"
+	MaxBodySizes map[string]int64
+	// MaxFileSize is the size of the largest file after a patch, in bytes,
+	// or zero for no limit
+	MaxFileSize int64
+	// UserRate and IPRate are the requests per second of each user and each
+	// address, with bursts of up to UserBurst and IPBurst requests, or zero
+	// for no limit
+	UserRate  float64
+	UserBurst int
+	IPRate    float64
+	IPBurst   int
+}
+
+// serverLimits are the limits of the server as configured
+var serverLimits = struct {
+	sync.RWMutex
+	config limitsConfiguration
+	users  *rateLimiter
+	ips    *rateLimiter
+}{config: limitsConfiguration{MaxBodySize: defaultMaxBodySize}}
+
+func pathToLimits() string {
+	return path.Join(getServerDataDir(), ".limits.toml")
+}
+
+// loadLimits loads the limits of the server, unless they are in the server
+// configuration.
+func loadLimits(configured *limitsConfiguration) (err error) {
+	config, err := readLimits(configured)
+	if err != nil {
+		return
+	}
+	setLimits(config)
+	return
+}
+
+// readLimits reads and validates the limits of the server, unless they are
+// in the server configuration.
+func readLimits(configured *limitsConfiguration) (config limitsConfiguration, err error) {
+	config = limitsConfiguration{MaxBodySize: defaultMaxBodySize}
+	if configured != nil {
+		config = *configured
+	} else if Exists(pathToLimits()) {
+		_, err = toml.DecodeFile(pathToLimits(), &config)
+		if err != nil {
+			return
+		}
+	}
+	err = config.validate()
+	return
+}
+
+func setLimits(config limitsConfiguration) {
+	serverLimits.Lock()
+	serverLimits.config = config
+	serverLimits.users = newRateLimiter(config.UserRate, config.UserBurst)
+	serverLimits.ips = newRateLimiter(config.IPRate, config.IPBurst)
+	serverLimits.Unlock()
+	log.Infof("max request size %s", humanize.Bytes(uint64(config.MaxBodySize)))
+}
+
+func (config limitsConfiguration) validate() error {
+	if config.MaxBodySize <= 0 {
+		return errors.New("MaxBodySize must be positive")
+	}
+	if config.MaxFileSize < 0 || config.UserRate < 0 || config.IPRate < 0 {
+		return errors.New("limits can not be negative")
+	}
+	// the chunks of a chunked upload must fit
+	if config.maxBodySize("/upload/chunk") < 2*uploadChunkSize {
+		return fmt.Errorf("max size of /upload/chunk must be at least %d", 2*uploadChunkSize)
+	}
+	return nil
+}
+
+// maxBodySize returns the size of the largest request body of an endpoint.
+func (config limitsConfiguration) maxBodySize(route string) int64 {
+	if size, ok := config.MaxBodySizes[route]; ok && size > 0 {
+		return size
+	}
+	return config.MaxBodySize
+}
+
+func getLimits() limitsConfiguration {
+	serverLimits.RLock()
+	defer serverLimits.RUnlock()
+	return serverLimits.config
+}
+
+// checkFileSize returns an error if a file would be larger than the limit.
+func checkFileSize(size int) error {
+	max := getLimits().MaxFileSize
+	if max > 0 && int64(size) > max {
+		return fmt.Errorf("file would be %s, larger than the limit of %s", humanize.Bytes(uint64(size)), humanize.Bytes(uint64(max)))
+	}
+	return nil
+}
+
+// limitHandler refuses requests that are too large or over the rate of
+// their address.
+func limitHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		// clients need the capabilities to know the limits
+		if route == "/capabilities" {
+			c.Next()
+			return
+		}
+		serverLimits.RLock()
+		config, ips := serverLimits.config, serverLimits.ips
+		serverLimits.RUnlock()
+
+		if wait, ok := ips.allow(c.ClientIP()); !ok {
+			abortRateLimited(c, wait, "too many requests from "+c.ClientIP())
+			return
+		}
+		max := config.maxBodySize(route)
+		if c.Request.ContentLength > max {
+			abortTooLarge(c, max)
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, max))
+			if err != nil {
+				abortTooLarge(c, max)
+				return
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if username := requestUsername(c, body); username != "" {
+			c.Set(requestUserKey, username)
+		}
+		c.Next()
+	}
+}
+
+// userLimitHandler refuses requests over the rate of their user, once the
+// user is known by the signature or client certificate of the request.
+// Other requests are only limited by their address, so that nobody can use
+// up the rate of another user.
+func userLimitHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == "/capabilities" {
+			c.Next()
+			return
+		}
+		username := authenticatedUser(c)
+		if username == "" {
+			c.Next()
+			return
+		}
+		serverLimits.RLock()
+		users := serverLimits.users
+		serverLimits.RUnlock()
+		if wait, ok := users.allow(username); !ok {
+			abortRateLimited(c, wait, "too many requests for "+username)
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticatedUser returns the user that the signature or client
+// certificate of a request is from, or who is signed in to the web UI
+// (other than an admin), if anyone.
+func authenticatedUser(c *gin.Context) string {
+	if username := c.GetString(signedUserKey); username != "" {
+		return username
+	}
+	if username, ok := certificateUser(c); ok {
+		return username
+	}
+	if viewer, ok := c.Get(uiViewerKey); ok && !viewer.(uiViewer).Admin {
+		return viewer.(uiViewer).Username
+	}
+	return ""
+}
+
+// requestUsername returns the user that a request is made for, without
+// binding the request.
+func requestUsername(c *gin.Context, body []byte) string {
+	if username := c.GetHeader(headerUser); username != "" {
+		return username
+	}
+	if username := c.Query("username"); username != "" {
+		return username
+	}
+	if username := c.Param("username"); username != "" {
+		return username
+	}
+	if len(body) == 0 {
+		return ""
+	}
+	var sr struct {
+		Username string `json:"username"`
+	}
+	if c.ContentType() == contentTypeBinary {
+		cbor.Unmarshal(body, &sr)
+	} else {
+		json.Unmarshal(body, &sr)
+	}
+	return sr.Username
+}
+
+func abortTooLarge(c *gin.Context, max int64) {
+	message := fmt.Sprintf("request is larger than the limit of %s", humanize.Bytes(uint64(max)))
+	log.Warnf("%s %s: %s", c.Request.RemoteAddr, c.Request.URL.Path, message)
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, serverResponse{Message: message})
+}
+
+func abortRateLimited(c *gin.Context, wait time.Duration, message string) {
+	log.Debugf("%s %s: %s", c.Request.RemoteAddr, c.Request.URL.Path, message)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, serverResponse{Message: message})
+}
+
+// rateLimiter is a token bucket for each key, which fills at rate tokens
+// per second up to burst tokens
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter, or nil if the rate is not limited.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for the key, or returns how long until there is one.
+func (l *rateLimiter) allow(key string) (wait time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, exists := l.buckets[key]
+	if !exists {
+		// forget the keys with full buckets now and then
+		if len(l.buckets) > 10000 {
+			for k, old := range l.buckets {
+				if old.tokens+now.Sub(old.last).Seconds()*l.rate >= l.burst {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// errTooLarge is returned when the server refused a request as too large
+var errTooLarge = errors.New("request too large for server")
+
+// rateLimitedError is returned when the server refused a request because
+// of its rate, and can be tried again after wait.
+type rateLimitedError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e rateLimitedError) Error() string {
+	return e.err.Error()
+}
+
+// retryAfter returns how long to wait before trying again, as asked by the
+// server.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		return retryBackoff
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait
+}
@@ -1,11 +1,27 @@
 package patchitup
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,4 +69,1595 @@ func TestPatchUp(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, originalHash, serverHash)
 
+	//
+	// check the history on the server
+	//
+	revisions, err := ListRevisions("http://localhost:8002", "testuser", "../test1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	diff, err := Diff("http://localhost:8002", "testuser", "../test1", fmt.Sprint(revisions[0]), "current", false)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(diff, "+func handlerPatch"))
+	diff, err = Diff("http://localhost:8002", "testuser", "../test1", fmt.Sprint(revisions[1]), "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "", diff)
+
+	//
+	// restore the first revision to a different path
+	//
+	err = Pull("http://localhost:8002", "testuser", "../test1", fmt.Sprint(revisions[1]-1), "../test1.restored")
+	assert.Nil(t, err)
+	defer os.Remove("../test1.restored")
+	originalHash, err = Filemd5Sum("client.go")
+	assert.Nil(t, err)
+	restoredHash, err := Filemd5Sum("../test1.restored")
+	assert.Nil(t, err)
+	assert.Equal(t, originalHash, restoredHash)
+	serverHash, err = Filemd5Sum(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test1"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, restoredHash, serverHash)
+}
+
+func TestDryRun(t *testing.T) {
+	SetLogLevel("info")
+	defer os.Remove("../test21")
+	assert.Nil(t, ioutil.WriteFile("../test21", []byte("hello\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8002", "dryrunuser", "../test21"))
+	pathToServerCopy := path.Join(UserHomeDir(), ".patchitup", "server", "dryrunuser", "test21")
+	pathToRemoteCopy := pathToCachedCopy("http://localhost:8002", "dryrunuser", "test21")
+
+	// a dry run leaves the server and the cached copy alone
+	assert.Nil(t, ioutil.WriteFile("../test21", []byte("hello world\n"), 0755))
+	assert.Nil(t, PatchUpWithOptions("http://localhost:8002", "dryrunuser", "../test21", Options{DryRun: true, ShowPatch: true}))
+	text, err := getFileText(pathToServerCopy)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", text)
+	text, err = getFileText(pathToRemoteCopy)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", text)
+	revisions, err := ListRevisions("http://localhost:8002", "dryrunuser", "../test21")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(revisions))
+
+	assert.Nil(t, PatchUp("http://localhost:8002", "dryrunuser", "../test21"))
+	text, _ = getFileText(pathToServerCopy)
+	assert.Equal(t, "hello world\n", text)
+
+	// or any cached copy of a new file
+	defer os.Remove("../test22")
+	pathToNewRemoteCopy := pathToCachedCopy("http://localhost:8002", "dryrunuser", "test22")
+	os.Remove(pathToNewRemoteCopy)
+	assert.Nil(t, ioutil.WriteFile("../test22", []byte("new\n"), 0755))
+	assert.Nil(t, PatchUpWithOptions("http://localhost:8002", "dryrunuser", "../test22", Options{DryRun: true}))
+	assert.False(t, Exists(pathToNewRemoteCopy))
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	text1 := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	text2 := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\n"
+	diff, hunks := unifiedDiff("x", "y", text1, text2)
+	assert.Equal(t, 1, len(hunks))
+	assert.Equal(t, `--- x
++++ y
+@@ -2,9 +2,10 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+ i
+ j
++k
+`, diff)
+
+	diff, hunks = unifiedDiff("x", "y", text1, text1)
+	assert.Equal(t, "", diff)
+	assert.Equal(t, 0, len(hunks))
+}
+
+func TestUnifiedPatch(t *testing.T) {
+	// random edits, with and without trailing newlines
+	words := []string{"a", "b", "c", "", "d"}
+	randomText := func(n int) string {
+		var lines []string
+		for i := 0; i < n; i++ {
+			lines = append(lines, words[rand.Intn(len(words))])
+		}
+		text := strings.Join(lines, "\n")
+		if rand.Intn(2) == 0 {
+			text += "\n"
+		}
+		return text
+	}
+	d := unifiedDiffer{}
+	for i := 0; i < 500; i++ {
+		text1, text2 := randomText(rand.Intn(30)), randomText(rand.Intn(30))
+		newText, err := d.Apply(text1, d.Diff("x", text1, text2))
+		assert.Nil(t, err)
+		assert.Equal(t, text2, newText)
+	}
+
+	// the patch does not apply to a different text
+	_, err := d.Apply("a\nb\n", d.Diff("x", "a\nc\n", "a\nd\n"))
+	assert.NotNil(t, err)
+
+	// the server applies unified patches
+	assert.Nil(t, ioutil.WriteFile("../test6", []byte("a\nb\nc\n"), 0755))
+	defer os.Remove("../test6")
+	patch, err := compressPatchWith(d.Diff("test6", "a\nb\nc\n", "a\nB\nc\n"), zstdCodec{}, d)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(patch, "codec=zstd;diff=unified:"))
+	assert.Nil(t, patchFile("../test6", patch))
+	text, err := getFileText("../test6")
+	assert.Nil(t, err)
+	assert.Equal(t, "a\nB\nc\n", text)
+	revisions, err := listRevisions("../test6")
+	assert.Nil(t, err)
+	for _, r := range revisions {
+		os.Remove(pathToRevision("../test6", r))
+	}
+
+	// large files are diffed by line, unless configured otherwise
+	caps := serverCapabilities()
+	assert.Equal(t, "diffmatchpatch", chooseDiffer("a.sql", 10, "", nil, caps).Name())
+	assert.Equal(t, "unified", chooseDiffer("a.sql", unifiedDiffSize+1, "", nil, caps).Name())
+	assert.Equal(t, "unified", chooseDiffer("a.sql", 10, "", map[string]string{"*.sql": "unified"}, caps).Name())
+	assert.Equal(t, "diffmatchpatch", chooseDiffer("a.sql", 10, "diffmatchpatch", map[string]string{"*.sql": "unified"}, caps).Name())
+	assert.Equal(t, "diffmatchpatch", chooseDiffer("a.sql", unifiedDiffSize+1, "", nil, legacyCapabilities).Name())
+}
+
+func TestChunkedUpload(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8003")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// random lines so that the compressed patch needs several chunks
+	var lines []string
+	for i := 0; i < 40000; i++ {
+		lines = append(lines, RandStringBytesMaskImprSrc(40))
+	}
+	err := ioutil.WriteFile("../test2", []byte(strings.Join(lines, "\n")), 0755)
+	assert.Nil(t, err)
+	defer os.Remove("../test2")
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test2"))
+
+	// start an upload and send only the first chunk, as if interrupted
+	text, err := getFileText("../test2")
+	assert.Nil(t, err)
+	patch := getPatch("", text)
+	assert.True(t, len(patch) > chunkedUploadSize)
+	target, err := postToServer("http://localhost:8003/upload/start", serverRequest{
+		Username: "testuser",
+		Filename: "test2",
+		Size:     len(patch),
+		Checksum: checksum([]byte(patch)),
+	})
+	assert.Nil(t, err)
+	_, err = postToServer("http://localhost:8003/upload/chunk", serverRequest{
+		Username: "testuser",
+		Filename: "test2",
+		Session:  target.Session,
+		Chunk:    0,
+		Data:     base64String(patch[:uploadChunkSize]),
+		Checksum: checksum([]byte(patch[:uploadChunkSize])),
+	})
+	assert.Nil(t, err)
+	chunks, err := receivedChunks(pathToCacheServer, target.Session)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0}, chunks)
+
+	// the upload resumes and is committed
+	err = PatchUpWithOptions("http://localhost:8003", "testuser", "../test2", Options{Compression: "gzip", DiffAlgorithm: "diffmatchpatch"})
+	assert.Nil(t, err)
+	originalHash, err := Filemd5Sum("../test2")
+	assert.Nil(t, err)
+	serverHash, err := Filemd5Sum(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test2"))
+	assert.Nil(t, err)
+	assert.Equal(t, originalHash, serverHash)
+	assert.False(t, Exists(pathToUploadSession(pathToCacheServer, target.Session)))
+}
+
+func TestQueue(t *testing.T) {
+	SetLogLevel("info")
+	maxRetries = 0
+	defer func() { maxRetries = 5 }()
+	os.RemoveAll(pathToQueue())
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test3"))
+	err := CopyFile("client.go", "../test3")
+	assert.Nil(t, err)
+	defer os.Remove("../test3")
+	err = CopyFile("server.go", "../test4")
+	assert.Nil(t, err)
+	defer os.Remove("../test4")
+
+	// server is down, so the upload is queued
+	err = PatchUp("http://localhost:8004", "testuser", "../test3")
+	assert.Nil(t, err)
+	assert.True(t, Exists(path.Join(pathToQueue(), queueKey("http://localhost:8004", "testuser", "test3")+".json")))
+
+	// the queued upload is flushed once the server is back, without the tag
+	// of the upload that flushes it
+	go func() {
+		err := Run("8004")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	err = PatchUpWithOptions("http://localhost:8004", "testuser", "../test4", Options{Tag: "release"})
+	assert.Nil(t, err)
+	tags, err := listTags(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test3"))
+	assert.Nil(t, err)
+	assert.Empty(t, tags)
+	tags, err = listTags(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test4"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tags))
+	assert.False(t, Exists(path.Join(pathToQueue(), queueKey("http://localhost:8004", "testuser", "test3")+".json")))
+	originalHash, err := Filemd5Sum("../test3")
+	assert.Nil(t, err)
+	serverHash, err := Filemd5Sum(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test3"))
+	assert.Nil(t, err)
+	assert.Equal(t, originalHash, serverHash)
+}
+
+func TestCommit(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8005")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "commituser"))
+	os.RemoveAll(pathToCommits(pathToCacheServer, "commituser"))
+	files := []string{"../schema.sql", "../data.sql", "../meta.json"}
+	for _, f := range files {
+		defer os.Remove(f)
+	}
+	write := func(version int) {
+		assert.Nil(t, ioutil.WriteFile(files[0], []byte(fmt.Sprintf("CREATE TABLE t%d (id INT);\n", version)), 0755))
+		assert.Nil(t, ioutil.WriteFile(files[1], []byte(fmt.Sprintf("INSERT INTO t%d VALUES (1);\n", version)), 0755))
+		assert.Nil(t, ioutil.WriteFile(files[2], []byte(fmt.Sprintf(`{"version": %d}`, version)), 0755))
+	}
+
+	// two commits of all three files
+	write(1)
+	id1, err := CommitFiles("http://localhost:8005", "commituser", files, "first", Options{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", id1)
+	write(2)
+	id2, err := CommitFiles("http://localhost:8005", "commituser", files, "second", Options{})
+	assert.Nil(t, err)
+	commits, err := ListCommits("http://localhost:8005", "commituser", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(commits))
+	assert.Equal(t, id1, commits[0].ID)
+	assert.Equal(t, id2, commits[1].ID)
+	assert.Equal(t, []string{"schema.sql", "data.sql", "meta.json"}, commits[0].Files)
+	for _, f := range commits[0].Files {
+		revisions, err := listRevisions(path.Join(UserHomeDir(), ".patchitup", "server", "commituser", f))
+		assert.Nil(t, err)
+		assert.Contains(t, revisions, commits[0].Revision)
+	}
+
+	// a commit with a patch that does not apply changes nothing
+	_, err = applyCommit(pathToCacheServer, "commituser", "bad", []commitFile{
+		{Filename: "schema.sql", Patch: base64String(getPatch("", "CREATE TABLE t3 (id INT);\n"))},
+		{Filename: "data.sql", Patch: "not a patch"},
+	})
+	assert.NotNil(t, err)
+	text, err := getFileText(path.Join(UserHomeDir(), ".patchitup", "server", "commituser", "schema.sql"))
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE t2 (id INT);\n", text)
+	commits, err = listCommits(pathToCacheServer, "commituser", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(commits))
+
+	// a commit that can not be recorded puts back the files it replaced
+	pathToUserCommits := pathToCommits(pathToCacheServer, "commituser")
+	assert.Nil(t, os.Rename(pathToUserCommits, pathToUserCommits+".moved"))
+	assert.Nil(t, ioutil.WriteFile(pathToUserCommits, []byte("not a folder"), 0755))
+	_, err = applyCommit(pathToCacheServer, "commituser", "unrecorded", []commitFile{
+		{Filename: "schema.sql", Patch: base64String(getPatch("CREATE TABLE t2 (id INT);\n", "CREATE TABLE t3 (id INT);\n"))},
+		{Filename: "new.sql", Patch: base64String(getPatch("", "SELECT 1;\n"))},
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, os.Remove(pathToUserCommits))
+	assert.Nil(t, os.Rename(pathToUserCommits+".moved", pathToUserCommits))
+	text, err = getFileText(path.Join(UserHomeDir(), ".patchitup", "server", "commituser", "schema.sql"))
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE t2 (id INT);\n", text)
+	assert.False(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "commituser", "new.sql")))
+	revisions, err := listRevisions(path.Join(UserHomeDir(), ".patchitup", "server", "commituser", "schema.sql"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+
+	// the files of the first commit are restored together
+	folder, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	err = PullCommit("http://localhost:8005", "commituser", id1[:8], folder)
+	assert.Nil(t, err)
+	write(1)
+	for _, f := range files {
+		originalHash, err := Filemd5Sum(f)
+		assert.Nil(t, err)
+		restoredHash, err := Filemd5Sum(path.Join(folder, path.Base(f)))
+		assert.Nil(t, err)
+		assert.Equal(t, originalHash, restoredHash)
+	}
+}
+
+func TestTags(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8006")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "taguser"))
+	defer os.Remove("../test7")
+
+	// five revisions, where the second is tagged at upload and the fourth later
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, ioutil.WriteFile("../test7", []byte(strings.Repeat(fmt.Sprintf("version %d\n", i), i)), 0755))
+		opts := Options{}
+		if i == 2 {
+			opts = Options{Tag: "before-migration-42", Message: "the old schema"}
+		}
+		assert.Nil(t, PatchUpWithOptions("http://localhost:8006", "taguser", "../test7", opts))
+		time.Sleep(2 * time.Millisecond)
+	}
+	pathToFile := path.Join(UserHomeDir(), ".patchitup", "server", "taguser", "test7")
+	revisions, err := listRevisions(pathToFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(revisions))
+	// a patch with a tag that is not valid is not applied
+	assert.Nil(t, ioutil.WriteFile("../test7", []byte("version 6\n"), 0755))
+	assert.NotNil(t, PatchUpWithOptions("http://localhost:8006", "taguser", "../test7", Options{Tag: "42"}))
+	rejected, err := listRevisions(pathToFile)
+	assert.Nil(t, err)
+	assert.Equal(t, revisions, rejected)
+	assert.Nil(t, ioutil.WriteFile("../test7", []byte(strings.Repeat("version 5\n", 5)), 0755))
+	assert.Nil(t, Tag("http://localhost:8006", "taguser", "../test7", "v4", "", fmt.Sprint(revisions[3])))
+	assert.NotNil(t, Tag("http://localhost:8006", "taguser", "../test7", "42", "", ""))
+	tags, err := ListTags("http://localhost:8006", "taguser", "../test7")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tags))
+	assert.Equal(t, "before-migration-42", tags[0].Name)
+	assert.Equal(t, "the old schema", tags[0].Message)
+	assert.Equal(t, revisions[1], tags[0].Revision)
+	assert.Equal(t, revisions[3], tags[1].Revision)
+
+	// restore by tag
+	err = Pull("http://localhost:8006", "taguser", "../test7", "before-migration-42", "../test7.restored")
+	assert.Nil(t, err)
+	defer os.Remove("../test7.restored")
+	text, err := getFileText("../test7.restored")
+	assert.Nil(t, err)
+	assert.Equal(t, "version 2\nversion 2\n", text)
+
+	// pruning keeps the tagged revisions and the latest one
+	err = Prune("http://localhost:8006", "taguser", "../test7", 1, "")
+	assert.Nil(t, err)
+	pruned, err := listRevisions(pathToFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{revisions[1], revisions[3], revisions[4]}, pruned)
+	for i, r := range []int64{revisions[1], revisions[3], revisions[4]} {
+		text, err := getRevisionText(pathToFile, r)
+		assert.Nil(t, err)
+		version := []int{2, 4, 5}[i]
+		assert.Equal(t, strings.Repeat(fmt.Sprintf("version %d\n", version), version), text)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8007")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "eventuser"))
+	os.RemoveAll(pathToCommits(pathToCacheServer, "eventuser"))
+	defer os.Remove("../test8")
+	defer os.Remove("../test8b")
+
+	ch := make(chan Event, 10)
+	go Subscribe("http://localhost:8007", "eventuser", ch)
+	// events of other users are not sent
+	other := make(chan Event, 10)
+	go Subscribe("http://localhost:8007", "otheruser", other)
+	time.Sleep(100 * time.Millisecond)
+	next := func() Event {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	assert.Nil(t, ioutil.WriteFile("../test8", []byte("hello\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8007", "eventuser", "../test8"))
+	e := next()
+	assert.Equal(t, EventCreate, e.Type)
+	assert.Equal(t, "eventuser", e.Username)
+	assert.Equal(t, "test8", e.Filename)
+	hash, err := Filemd5Sum("../test8")
+	assert.Nil(t, err)
+	assert.Equal(t, hash, e.Hash)
+	assert.True(t, e.Size > 0)
+
+	assert.Nil(t, ioutil.WriteFile("../test8", []byte("hello\nworld\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8007", "eventuser", "../test8"))
+	e = next()
+	assert.Equal(t, EventPatch, e.Type)
+	assert.NotEqual(t, hash, e.Hash)
+
+	assert.Nil(t, Pull("http://localhost:8007", "eventuser", "../test8", fmt.Sprint(e.Revision), "../test8.restored"))
+	defer os.Remove("../test8.restored")
+	assert.Equal(t, EventRestore, next().Type)
+
+	// deleting a file removes it from the commits and its tags
+	assert.Nil(t, ioutil.WriteFile("../test8", []byte("hello\nworld\nagain\n"), 0755))
+	assert.Nil(t, ioutil.WriteFile("../test8b", []byte("other\n"), 0755))
+	_, err = CommitFiles("http://localhost:8007", "eventuser", []string{"../test8", "../test8b"}, "both", Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, Tag("http://localhost:8007", "eventuser", "../test8", "v1", "", ""))
+	pathToServerFile := path.Join(UserHomeDir(), ".patchitup", "server", "eventuser", "test8")
+	assert.True(t, Exists(pathToTags(pathToServerFile)))
+
+	assert.Nil(t, Delete("http://localhost:8007", "eventuser", "../test8"))
+	for e = next(); e.Type != EventDelete; e = next() {
+	}
+	assert.False(t, Exists(pathToServerFile))
+	assert.False(t, Exists(pathToTags(pathToServerFile)))
+	commits, err := listCommits(pathToCacheServer, "eventuser", "")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(commits)) {
+		assert.Equal(t, []string{"test8b"}, commits[0].Files)
+	}
+	assert.Equal(t, 0, len(other))
+}
+
+func TestWebhooks(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8008")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "hookuser"))
+	os.Remove(pathToWebhookLog())
+	webhookBackoff = 10 * time.Millisecond
+	defer func() { webhookBackoff = 1 * time.Second }()
+
+	// a receiver that fails the first delivery
+	received := make(chan Event, 10)
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, signWebhook("secret", body), r.Header.Get("X-Patchitup-Signature"))
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var e Event
+		assert.Nil(t, json.Unmarshal(body, &e))
+		assert.Equal(t, e.Type, r.Header.Get("X-Patchitup-Event"))
+		received <- e
+	}))
+	defer receiver.Close()
+	setWebhooks([]webhook{{
+		URL:    receiver.URL,
+		Secret: "secret",
+		Users:  []string{"hookuser"},
+		Files:  []string{"*.sql"},
+	}})
+	defer setWebhooks(nil)
+	next := func() Event {
+		select {
+		case e := <-received:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("no webhook")
+		}
+		return Event{}
+	}
+
+	defer os.Remove("../hook.sql")
+	defer os.Remove("../hook.txt")
+	assert.Nil(t, ioutil.WriteFile("../hook.txt", []byte("not a match\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8008", "hookuser", "../hook.txt"))
+	assert.Nil(t, ioutil.WriteFile("../hook.sql", []byte("CREATE TABLE t (id INT);\n"), 0755))
+	err := PatchUp("http://localhost:8008", "hookuser", "../hook.sql")
+	assert.Nil(t, err)
+	e := next()
+	assert.Equal(t, EventCreate, e.Type)
+	assert.Equal(t, "hook.sql", e.Filename)
+
+	// both attempts are in the delivery log
+	var deliveries []webhookDelivery
+	for i := 0; i < 100 && len(deliveries) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		deliveries, err = listDeliveries("hookuser")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, len(deliveries))
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].Status)
+	assert.Equal(t, http.StatusOK, deliveries[1].Status)
+	assert.Equal(t, deliveries[0].ID, deliveries[1].ID)
+
+	// the test endpoint sends a test event
+	assert.Nil(t, PingWebhooks("http://localhost:8008", "hookuser"))
+	assert.Equal(t, EventTest, next().Type)
+
+	// a test event is sent once, without retrying a webhook that is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	setWebhooks([]webhook{{URL: down.URL, Users: []string{"hookuser"}}})
+	assert.Nil(t, PingWebhooks("http://localhost:8008", "hookuser"))
+	deliveries, err = listDeliveries("hookuser")
+	assert.Nil(t, err)
+	attempts := 0
+	for _, d := range deliveries {
+		if d.URL == down.URL {
+			attempts++
+			assert.NotEqual(t, "", d.Error)
+		}
+	}
+	assert.Equal(t, 1, attempts)
+
+	// the delivery log keeps the latest attempts of each webhook
+	webhookLogKeep = 3
+	defer func() { webhookLogKeep = 100 }()
+	for i := 1; i <= 10; i++ {
+		recordDelivery(webhookDelivery{ID: fmt.Sprint(i), URL: down.URL, Event: Event{Username: "hookuser"}})
+	}
+	deliveries, err = listDeliveries("hookuser")
+	assert.Nil(t, err)
+	var ids []string
+	for _, d := range deliveries {
+		if d.URL == down.URL {
+			ids = append(ids, d.ID)
+		}
+	}
+	assert.True(t, len(ids) <= 2*webhookLogKeep)
+	assert.Equal(t, "10", ids[len(ids)-1])
+	assert.NotContains(t, ids, "1")
+
+	// webhooks need a secret
+	defer os.Remove(pathToWebhooks())
+	assert.Nil(t, ioutil.WriteFile(pathToWebhooks(), []byte("[[Webhook]]\nURL = \"https://example.com\"\n"), 0644))
+	_, err = readWebhooks()
+	assert.NotNil(t, err)
+}
+
+func TestMerge3(t *testing.T) {
+	base := "a\nb\nc\nd\ne\nf\ng\n"
+	// changes apart from each other are both kept
+	merged, conflicts := merge3(base, "A\nb\nc\nd\ne\nf\ng\n", "a\nb\nc\nd\ne\nf\nG\nh\n")
+	assert.Equal(t, 0, conflicts)
+	assert.Equal(t, "A\nb\nc\nd\ne\nf\nG\nh\n", merged)
+	// the same change on both sides is not a conflict
+	merged, conflicts = merge3(base, "a\nb\nC\nd\ne\nf\ng\n", "a\nb\nC\nd\ne\nf\ng\n")
+	assert.Equal(t, 0, conflicts)
+	assert.Equal(t, "a\nb\nC\nd\ne\nf\ng\n", merged)
+	// different changes to the same lines are
+	merged, conflicts = merge3(base, "a\nb\nlocal\nd\ne\nf\ng", "a\nb\nremote\nd\ne\nf\nh")
+	assert.Equal(t, 2, conflicts)
+	assert.Equal(t, "a\nb\n<<<<<<< local\nlocal\n=======\nremote\n>>>>>>> remote\nd\ne\nf\n<<<<<<< local\ng\n=======\nh\n>>>>>>> remote\n", merged)
+}
+
+func TestSync(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8009")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "syncuser"))
+	os.Remove(pathToCachedCopy("http://localhost:8009", "syncuser", "test10"))
+	defer os.Remove("../test10")
+	pathToServerCopy := path.Join(UserHomeDir(), ".patchitup", "server", "syncuser", "test10")
+	// editServer changes the file on the server as another device would
+	editServer := func(text string) {
+		oldText, err := getFileText(pathToServerCopy)
+		assert.Nil(t, err)
+		assert.Nil(t, patchFile(pathToServerCopy, compressPatch(getPatchText(oldText, text))))
+	}
+
+	config := "port = 80\nhost = localhost\nworkers = 4\ndebug = false\ntimeout = 30\n"
+	assert.Nil(t, ioutil.WriteFile("../test10", []byte(config), 0755))
+	conflicts, err := Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, conflicts)
+	text, _ := getFileText(pathToServerCopy)
+	assert.Equal(t, config, text)
+
+	// changes only on the server are pulled
+	editServer("port = 8080\nhost = localhost\nworkers = 4\ndebug = false\ntimeout = 30\n")
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, conflicts)
+	text, _ = getFileText("../test10")
+	assert.Equal(t, "port = 8080\nhost = localhost\nworkers = 4\ndebug = false\ntimeout = 30\n", text)
+
+	// changes on both sides are merged and uploaded
+	editServer("port = 8080\nhost = localhost\nworkers = 8\ndebug = false\ntimeout = 30\n")
+	assert.Nil(t, ioutil.WriteFile("../test10", []byte("port = 8080\nhost = localhost\nworkers = 4\ndebug = false\ntimeout = 60\n"), 0755))
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, conflicts)
+	merged := "port = 8080\nhost = localhost\nworkers = 8\ndebug = false\ntimeout = 60\n"
+	text, _ = getFileText("../test10")
+	assert.Equal(t, merged, text)
+	text, _ = getFileText(pathToServerCopy)
+	assert.Equal(t, merged, text)
+
+	// conflicts are marked locally and not uploaded
+	editServer("port = 8080\nhost = example.com\nworkers = 8\ndebug = false\ntimeout = 60\n")
+	assert.Nil(t, ioutil.WriteFile("../test10", []byte("port = 8080\nhost = 0.0.0.0\nworkers = 8\ndebug = false\ntimeout = 60\n"), 0755))
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, conflicts)
+	text, _ = getFileText("../test10")
+	assert.Equal(t, "port = 8080\n<<<<<<< local\nhost = 0.0.0.0\n=======\nhost = example.com\n>>>>>>> remote\nworkers = 8\ndebug = false\ntimeout = 60\n", text)
+	text, _ = getFileText(pathToServerCopy)
+	assert.Equal(t, "port = 8080\nhost = example.com\nworkers = 8\ndebug = false\ntimeout = 60\n", text)
+	// syncing again before they are resolved does not upload the markers
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, conflicts)
+	text, _ = getFileText(pathToServerCopy)
+	assert.Equal(t, "port = 8080\nhost = example.com\nworkers = 8\ndebug = false\ntimeout = 60\n", text)
+
+	// once resolved, the next sync uploads the file
+	assert.Nil(t, ioutil.WriteFile("../test10", []byte("port = 8080\nhost = 0.0.0.0\nworkers = 8\ndebug = false\ntimeout = 60\n"), 0755))
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, conflicts)
+	text, _ = getFileText(pathToServerCopy)
+	assert.Equal(t, "port = 8080\nhost = 0.0.0.0\nworkers = 8\ndebug = false\ntimeout = 60\n", text)
+
+	// a file on a device that never synced it, which matches the server,
+	// is in sync
+	assert.Nil(t, os.Remove(pathToCachedCopy("http://localhost:8009", "syncuser", "test10")))
+	conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, conflicts)
+
+	// a file on the server without a final newline is pulled exactly, and
+	// the next sync changes nothing
+	editServer("port = 8080\nhost = 0.0.0.0")
+	revisions, err := listRevisions(pathToServerCopy)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		conflicts, err = Sync("http://localhost:8009", "syncuser", "../test10", Options{})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, conflicts)
+		text, _ = getFileText("../test10")
+		assert.Equal(t, "port = 8080\nhost = 0.0.0.0", text)
+	}
+	synced, err := listRevisions(pathToServerCopy)
+	assert.Nil(t, err)
+	assert.Equal(t, revisions, synced)
+}
+
+func TestProfiles(t *testing.T) {
+	configFile := path.Join(UserHomeDir(), ".patchitup", "client", "config.toml")
+	bConfig, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		defer ioutil.WriteFile(configFile, bConfig, 0755)
+	} else {
+		defer os.Remove(configFile)
+	}
+	os.MkdirAll(path.Join(UserHomeDir(), ".patchitup", "client"), 0755)
+	defer SetProfile("")
+
+	c, err := handleConfiguration("http://localhost:8002", "produser")
+	assert.Nil(t, err)
+	SetProfile("staging")
+	_, err = handleConfiguration("", "")
+	assert.NotNil(t, err)
+	c, err = handleConfiguration("https://staging.example.com:8002", "staginguser")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://staging.example.com:8002", c.ServerAddress)
+	assert.Equal(t, "staginguser", c.Username)
+
+	// each profile remembers its own server
+	c, err = handleConfiguration("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://staging.example.com:8002", c.ServerAddress)
+	SetProfile("")
+	c, err = handleConfiguration("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localhost:8002", c.ServerAddress)
+	assert.Equal(t, "produser", c.Username)
+
+	// each profile has its own timeout and retries
+	var config clientConfiguration
+	_, err = toml.DecodeFile(configFile, &config)
+	assert.Nil(t, err)
+	staging := config.Profiles["staging"]
+	staging.Timeout, staging.Retries = 7, 2
+	config.Profiles["staging"] = staging
+	buf := new(bytes.Buffer)
+	assert.Nil(t, toml.NewEncoder(buf).Encode(config))
+	assert.Nil(t, ioutil.WriteFile(configFile, buf.Bytes(), 0600))
+	_, err = handleProfileConfiguration("staging", "", "")
+	assert.Nil(t, err)
+	_, err = handleProfileConfiguration("", "", "")
+	assert.Nil(t, err)
+	settings := getRequestSettings("https://staging.example.com:8002/patch")
+	assert.Equal(t, 7*time.Second, settings.timeout)
+	assert.Equal(t, 2, settings.retries)
+	assert.Equal(t, defaultTimeout, getRequestSettings("http://localhost:8002/patch").timeout)
+
+	// only the user can read the configuration
+	assert.Nil(t, os.Chmod(configFile, 0755))
+	_, err = handleConfiguration("", "")
+	assert.Nil(t, err)
+	info, err := os.Stat(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the copies of the same file on different servers are cached apart
+	assert.Equal(t, path.Join(pathToCacheClient, "remote", "staging.example.com_8002", "u", "f"), pathToCachedCopy("https://staging.example.com:8002", "u", "f"))
+	assert.NotEqual(t, pathToCachedCopy("http://localhost:8002", "u", "f"), pathToCachedCopy("http://localhost:8003", "u", "f"))
+}
+
+func TestPatchUpTo(t *testing.T) {
+	SetLogLevel("info")
+	maxRetries = 0
+	defer func() { maxRetries = 5 }()
+	go func() {
+		err := Run("8010")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for _, username := range []string{"fanuser1", "fanuser2"} {
+		os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", username))
+	}
+	defer os.Remove("../test11")
+	defer removeFromQueue("http://localhost:8019", "fanuser3", "test11")
+
+	destinations := []Destination{
+		{ServerAddress: "http://localhost:8010", Username: "fanuser1"},
+		{ServerAddress: "http://localhost:8010", Username: "fanuser2"},
+	}
+	assert.Nil(t, CopyFile("client.go", "../test11"))
+	results, err := PatchUpTo(destinations, "../test11", PolicyAll, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+		// the uploads are counted apart
+		transferred, _ := getBandwidth(r.ServerAddress, r.Username)
+		assert.True(t, transferred > 0)
+		text, _ := getFileText(path.Join(UserHomeDir(), ".patchitup", "server", r.Username, "test11"))
+		expected, _ := getFileText("client.go")
+		assert.Equal(t, expected, text)
+	}
+
+	// one of three destinations is down, which is still a quorum
+	destinations = append(destinations, Destination{ServerAddress: "http://localhost:8019", Username: "fanuser3"})
+	assert.Nil(t, CopyFile("server.go", "../test11"))
+	results, err = PatchUpTo(destinations, "../test11", PolicyAll, Options{})
+	assert.NotNil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.Nil(t, results[1].Err)
+	assert.True(t, isUnreachable(results[2].Err))
+	assert.True(t, Exists(path.Join(pathToQueue(), queueKey("http://localhost:8019", "fanuser3", "test11")+".json")))
+	_, err = PatchUpTo(destinations, "../test11", PolicyQuorum, Options{})
+	assert.Nil(t, err)
+	_, err = PatchUpTo(destinations[2:], "../test11", PolicyAny, Options{})
+	assert.NotNil(t, err)
+	_, err = PatchUpTo(destinations, "../test11", "most", Options{})
+	assert.NotNil(t, err)
+}
+
+func TestReplication(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8011")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "repuser"))
+	defer os.Remove("../test12")
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, ioutil.WriteFile("../test12", []byte(strings.Repeat(fmt.Sprintf("line %d\n", i), i)), 0755))
+		assert.Nil(t, PatchUp("http://localhost:8011", "repuser", "../test12"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	pathToFile := path.Join(UserHomeDir(), ".patchitup", "server", "repuser", "test12")
+	replicas, err := getReplicaRevisions(pathToFile, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(replicas))
+	assert.Equal(t, md5Text(""), replicas[0].BaseHash)
+	assert.Equal(t, replicas[0].Hash, replicas[1].BaseHash)
+	hash, _ := Filemd5Sum(pathToFile)
+	assert.Equal(t, hash, replicas[2].Hash)
+	later, err := getReplicaRevisions(pathToFile, replicas[0].Revision)
+	assert.Nil(t, err)
+	assert.Equal(t, replicas[1:], later)
+	files, err := listReplicaFiles(pathToCacheServer)
+	assert.Nil(t, err)
+	found := false
+	for _, f := range files {
+		if f.Username == "repuser" && f.Filename == "test12" {
+			found = true
+			assert.Equal(t, replicas[2].Revision, f.Revision)
+			assert.Equal(t, hash, f.Hash)
+		}
+	}
+	assert.True(t, found)
+
+	// apply the revisions on a secondary server
+	secondary, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(secondary)
+	applied, err := applyReplicaRevisions(secondary, "repuser", "test12", replicas[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, applied)
+	// a revision is only applied on top of its base
+	_, err = applyReplicaRevisions(secondary, "repuser", "test12", replicas[2:])
+	assert.NotNil(t, err)
+	// revisions that were already replicated are skipped
+	applied, err = applyReplicaRevisions(secondary, "repuser", "test12", replicas)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, applied)
+	text, _ := getFileText(path.Join(secondary, "repuser", "test12"))
+	assert.Equal(t, "line 3\nline 3\nline 3\n", text)
+	revisions, _ := listRevisions(path.Join(secondary, "repuser", "test12"))
+	assert.Equal(t, []int64{replicas[0].Revision, replicas[1].Revision, replicas[2].Revision}, revisions)
+
+	// the replication endpoints are only served when replication is
+	// configured
+	resp, err := http.Get("http://localhost:8011/replica/files")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// servers replicate with the shared secret
+	primaryRouter := newRouter(pathToCacheServer)
+	addReplicationRoutes(primaryRouter)
+	primary := httptest.NewServer(primaryRouter)
+	defer primary.Close()
+	secondaryRouter := newRouter(secondary)
+	addReplicationRoutes(secondaryRouter)
+	replica := httptest.NewServer(secondaryRouter)
+	defer replica.Close()
+	setReplication(replicationConfig{Replicas: []string{replica.URL}, Primary: primary.URL, Secret: "shared"})
+	defer setReplication(replicationConfig{})
+	setServerDataDir(secondary)
+	defer setServerDataDir("")
+	resp, err = http.Get(primary.URL + "/replica/files")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	_, err = postToPeer(replica.URL+"/replicate", serverRequest{Username: "repuser", Filename: "test12"})
+	assert.Nil(t, err)
+
+	// revisions are forwarded to the secondary server
+	assert.Nil(t, ioutil.WriteFile("../test12", []byte("line 4\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8011", "repuser", "../test12"))
+	time.Sleep(100 * time.Millisecond)
+	text, _ = getFileText(path.Join(secondary, "repuser", "test12"))
+	assert.Equal(t, "line 4\n", text)
+	// one revision after another, in order
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * time.Millisecond)
+		assert.Nil(t, ioutil.WriteFile("../test12", []byte(fmt.Sprintf("line 4\nline %d\n", i)), 0755))
+		assert.Nil(t, PatchUp("http://localhost:8011", "repuser", "../test12"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	text, _ = getFileText(path.Join(secondary, "repuser", "test12"))
+	assert.Equal(t, "line 4\nline 4\n", text)
+	revisions, _ = listRevisions(path.Join(secondary, "repuser", "test12"))
+	primaryRevisions, _ := listRevisions(pathToFile)
+	assert.Equal(t, primaryRevisions, revisions)
+
+	// a file that is out of sync is copied again when catching up
+	assert.Nil(t, ioutil.WriteFile(path.Join(secondary, "repuser", "test12"), []byte("diverged\n"), 0755))
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, ioutil.WriteFile("../test12", []byte("line 5\n"), 0755))
+	// the secondary server misses the revision
+	setReplication(replicationConfig{Replicas: []string{"http://localhost:1"}, Primary: primary.URL, Secret: "shared"})
+	assert.Nil(t, PatchUp("http://localhost:8011", "repuser", "../test12"))
+	assert.Nil(t, catchUp(primary.URL))
+	text, _ = getFileText(path.Join(secondary, "repuser", "test12"))
+	assert.Equal(t, "line 5\n", text)
+	revisions, _ = listRevisions(path.Join(secondary, "repuser", "test12"))
+	primaryRevisions, _ = listRevisions(pathToFile)
+	assert.Equal(t, primaryRevisions[len(primaryRevisions)-1], revisions[len(revisions)-1])
+
+	// a server with another secret is refused
+	req, err := http.NewRequest("GET", primary.URL+"/replica/files", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, signPeerRequest(req, "wrong", nil))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	// the revisions are only served by a primary server
+	setReplication(replicationConfig{Primary: primary.URL, Secret: "shared"})
+	assert.NotNil(t, catchUp(primary.URL))
+}
+
+func TestBundle(t *testing.T) {
+	SetLogLevel("info")
+	go func() {
+		err := Run("8012")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "bundleuser"))
+	os.Remove(pathToCachedCopy("http://localhost:8012", "bundleuser", "test13"))
+	os.Remove(pathToCachedCopy("http://localhost:8012", "bundleuser", "test14"))
+	defer os.Remove("../test13")
+	defer os.Remove("../test14")
+	defer os.Remove("../test.bundle")
+	pathToServerFiles := path.Join(UserHomeDir(), ".patchitup", "server", "bundleuser")
+
+	assert.Nil(t, ioutil.WriteFile("../test13", []byte("monday\n"), 0755))
+	assert.Nil(t, PatchUp("http://localhost:8012", "bundleuser", "../test13"))
+
+	// the changes and a new file are bundled without the server
+	assert.Nil(t, ioutil.WriteFile("../test13", []byte("monday\ntuesday\n"), 0755))
+	assert.Nil(t, ioutil.WriteFile("../test14", []byte("new\n"), 0755))
+	assert.Nil(t, CreateBundle("http://localhost:8012", "bundleuser", []string{"../test13", "../test14"}, "../test.bundle", Options{}))
+	text, _ := getFileText(path.Join(pathToServerFiles, "test13"))
+	assert.Equal(t, "monday\n", text)
+
+	id, err := ImportBundle("", "../test.bundle")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", id)
+	text, _ = getFileText(path.Join(pathToServerFiles, "test13"))
+	assert.Equal(t, "monday\ntuesday\n", text)
+	text, _ = getFileText(path.Join(pathToServerFiles, "test14"))
+	assert.Equal(t, "new\n", text)
+	// importing it again does nothing
+	id, err = ImportBundle("", "../test.bundle")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	// the next bundle is not imported on top of a different file
+	assert.Nil(t, ioutil.WriteFile("../test13", []byte("monday\ntuesday\nwednesday\n"), 0755))
+	assert.Nil(t, ioutil.WriteFile("../test14", []byte("newer\n"), 0755))
+	assert.Nil(t, CreateBundle("http://localhost:8012", "bundleuser", []string{"../test13", "../test14"}, "../test.bundle", Options{}))
+	assert.Nil(t, patchFile(path.Join(pathToServerFiles, "test13"), compressPatch(getPatchText("monday\ntuesday\n", "sunday\n"))))
+	_, err = ImportBundle("", "../test.bundle")
+	assert.NotNil(t, err)
+	text, _ = getFileText(path.Join(pathToServerFiles, "test14"))
+	assert.Equal(t, "new\n", text)
+	_, err = ImportBundle("", "../test13")
+	assert.NotNil(t, err)
+
+	// a file can only be in a bundle once
+	b, err := readBundle("../test.bundle")
+	assert.Nil(t, err)
+	b.Files = []bundleFile{b.Files[1], b.Files[1]}
+	_, err = importBundle(pathToCacheServer, b)
+	assert.NotNil(t, err)
+	text, _ = getFileText(path.Join(pathToServerFiles, "test14"))
+	assert.Equal(t, "new\n", text)
+}
+
+func TestLocalTransport(t *testing.T) {
+	SetLogLevel("info")
+	maxRetries = 0
+	defer func() { maxRetries = 5 }()
+	folder, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	address := "file://" + folder
+	defer os.Remove("../test15")
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, ioutil.WriteFile("../test15", []byte(strings.Repeat(fmt.Sprintf("version %d\n", i), i)), 0755))
+		assert.Nil(t, PatchUp(address, "localuser", "../test15"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	text, err := getFileText(path.Join(folder, "localuser", "test15"))
+	assert.Nil(t, err)
+	assert.Equal(t, "version 3\nversion 3\nversion 3\n", text)
+	revisions, err := ListRevisions(address, "localuser", "../test15")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(revisions))
+	assert.Nil(t, Pull(address, "localuser", "../test15", fmt.Sprint(revisions[0]), "../test15.restored"))
+	defer os.Remove("../test15.restored")
+	text, _ = getFileText("../test15.restored")
+	assert.Equal(t, "version 1\n", text)
+	// the server storage is left alone
+	assert.False(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "localuser")))
+
+	// a directory that is not there is queued like an unreachable server
+	missing := "file://" + path.Join(folder, "unmounted")
+	assert.Nil(t, PatchUp(missing, "localuser", "../test15"))
+	assert.True(t, Exists(path.Join(pathToQueue(), queueKey(missing, "localuser", "test15")+".json")))
+	removeFromQueue(missing, "localuser", "test15")
+	assert.False(t, Exists(path.Join(folder, "unmounted")))
+}
+
+func TestTLS(t *testing.T) {
+	SetLogLevel("info")
+	maxRetries = 0
+	defer func() { maxRetries = 5 }()
+	folder, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	pathToCert, pathToKey := path.Join(folder, "cert.pem"), path.Join(folder, "key.pem")
+	pathToClientCert, pathToClientKey := path.Join(folder, "client.pem"), path.Join(folder, "client.key")
+	assert.Nil(t, generateCertificate(pathToCert, pathToKey, "patchitup", []string{"localhost", "127.0.0.1"}))
+	assert.Nil(t, generateCertificate(pathToClientCert, pathToClientKey, "tlsuser", nil))
+
+	// the server requires client certificates
+	assert.Nil(t, ioutil.WriteFile(pathToTLS(), []byte(fmt.Sprintf("Cert = %q\nKey = %q\nClientCA = %q\n", pathToCert, pathToKey, pathToClientCert)), 0755))
+	defer os.Remove(pathToTLS())
+	SetTLS(true)
+	defer SetTLS(false)
+	go func() {
+		err := Run("8013")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "tlsuser"))
+	defer os.Remove("../test16")
+	assert.Nil(t, ioutil.WriteFile("../test16", []byte("secret\n"), 0755))
+
+	// a client that does not pin the certificate does not connect
+	err = PatchUp("https://localhost:8013", "tlsuser", "../test16")
+	assert.NotNil(t, err)
+	assert.True(t, isCertificateError(err))
+
+	configFile := path.Join(UserHomeDir(), ".patchitup", "client", "config.toml")
+	bConfig, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		defer ioutil.WriteFile(configFile, bConfig, 0755)
+	} else {
+		defer os.Remove(configFile)
+	}
+	defer SetProfile("")
+	for _, p := range []struct {
+		name, cert, username string
+	}{
+		{"nocert", "", "tlsuser"},
+		{"secure", pathToClientCert, "tlsuser"},
+		{"other", pathToClientCert, "otheruser"},
+	} {
+		key := ""
+		if p.cert != "" {
+			key = pathToClientKey
+		}
+		assert.Nil(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf("[Profiles.%s]\nServerAddress = %q\nUsername = %q\nCA = %q\nCert = %q\nKey = %q\n", p.name, "https://localhost:8013", p.username, pathToCert, p.cert, key)), 0755))
+		SetProfile(p.name)
+		err = PatchUp("", "", "../test16")
+		switch p.name {
+		case "nocert":
+			// the server wants a certificate
+			assert.NotNil(t, err)
+			assert.False(t, isUnreachable(err))
+		case "secure":
+			assert.Nil(t, err)
+			assert.True(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "tlsuser", "test16")))
+		case "other":
+			// the certificate is only good for its own user
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "certificate of 'tlsuser'")
+		}
+	}
+}
+
+func TestSigning(t *testing.T) {
+	SetLogLevel("info")
+	assert.Nil(t, ioutil.WriteFile(pathToSecrets(), []byte("[Secrets]\nsignuser = \"s3cret\"\n"), 0755))
+	defer os.Remove(pathToSecrets())
+	go func() {
+		err := Run("8014")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "signuser"))
+	defer os.Remove("../test17")
+	assert.Nil(t, ioutil.WriteFile("../test17", []byte("signed\n"), 0755))
+
+	// the user has a secret, so unsigned requests are refused
+	err := PatchUp("http://localhost:8014", "signuser", "../test17")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "must be signed")
+
+	configFile := path.Join(UserHomeDir(), ".patchitup", "client", "config.toml")
+	bConfig, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		defer ioutil.WriteFile(configFile, bConfig, 0755)
+	} else {
+		defer os.Remove(configFile)
+	}
+	defer SetProfile("")
+	defer delete(clientSecrets.secrets, clientSecret{"http://localhost:8014", "signuser"})
+	SetProfile("signed")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("[Profiles.signed]\nServerAddress = \"http://localhost:8014\"\nUsername = \"signuser\"\nSecret = \"wrong\"\n"), 0755))
+	err = PatchUp("", "", "../test17")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad signature")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("[Profiles.signed]\nServerAddress = \"http://localhost:8014\"\nUsername = \"signuser\"\nSecret = \"s3cret\"\n"), 0755))
+	assert.Nil(t, PatchUp("", "", "../test17"))
+	assert.True(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "signuser", "test17")))
+
+	// a bundle is imported with the secret of its user
+	defer os.Remove("../test17.bundle")
+	assert.Nil(t, ioutil.WriteFile("../test17", []byte("signed\nbundled\n"), 0755))
+	assert.Nil(t, CreateBundle("", "", []string{"../test17"}, "../test17.bundle", Options{}))
+	delete(clientSecrets.secrets, clientSecret{"http://localhost:8014", "signuser"})
+	_, err = ImportBundle("", "../test17.bundle")
+	assert.Nil(t, err)
+	text, _ := getFileText(path.Join(UserHomeDir(), ".patchitup", "server", "signuser", "test17"))
+	assert.Equal(t, "signed\nbundled\n", text)
+
+	// a signed request is only accepted once, and only while it is fresh
+	body := []byte(`{"username":"signuser","filename":"test17"}`)
+	send := func(req *http.Request) int {
+		resp, err := httpClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	req, _ := http.NewRequest("POST", "http://localhost:8014/fileHash", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	assert.Nil(t, signRequest(req, "signuser", body))
+	replay := req.Clone(req.Context())
+	requests := getBandwidthOf("signuser").Requests
+	assert.Equal(t, http.StatusOK, send(req))
+	replay.Body = ioutil.NopCloser(bytes.NewReader(body))
+	assert.Equal(t, http.StatusUnauthorized, send(replay))
+	// only the signed request counts towards the bandwidth of the user
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, requests+1, getBandwidthOf("signuser").Requests)
+
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	req, _ = http.NewRequest("POST", "http://localhost:8014/fileHash", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set(headerUser, "signuser")
+	req.Header.Set(headerTimestamp, stale)
+	req.Header.Set(headerNonce, "stale")
+	req.Header.Set(headerSignature, signature("s3cret", "signuser", "POST", "/fileHash", stale, "stale", body))
+	assert.Equal(t, http.StatusUnauthorized, send(req))
+
+	// tampering with the body breaks the signature
+	req, _ = http.NewRequest("POST", "http://localhost:8014/fileHash", bytes.NewReader(body))
+	assert.Nil(t, signRequest(req, "signuser", body))
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"username":"signuser","filename":"other"}`))
+	req.ContentLength = -1
+	assert.Equal(t, http.StatusUnauthorized, send(req))
+
+	// a signature is only good for the endpoint it was made for
+	req, _ = http.NewRequest("POST", "http://localhost:8014/fileHash", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	assert.Nil(t, signRequest(req, "signuser", body))
+	req.URL.Path = "/delete"
+	assert.Equal(t, http.StatusUnauthorized, send(req))
+	assert.True(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "signuser", "test17")))
+	req, _ = http.NewRequest("GET", "http://localhost:8014/events?username=signuser", nil)
+	assert.Nil(t, signRequest(req, "signuser", nil))
+	req.URL.RawQuery = "username=otheruser"
+	assert.Equal(t, http.StatusUnauthorized, send(req))
+}
+
+func TestLimits(t *testing.T) {
+	SetLogLevel("info")
+	assert.Nil(t, ioutil.WriteFile(pathToLimits(), []byte("MaxFileSize = 50000\n[MaxBodySizes]\n\"/patch\" = 4096\n"), 0755))
+	defer loadLimits(nil)
+	defer os.Remove(pathToLimits())
+	go func() {
+		err := Run("8015")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	address := "http://localhost:8015"
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "limituser"))
+	defer os.Remove("../test18")
+
+	// the client learns to upload large patches in chunks
+	caps, err := getCapabilities(address)
+	assert.Nil(t, err)
+	assert.Equal(t, 2048, caps.Limits.ChunkedUploadSize)
+	assert.Equal(t, int64(50000), caps.Limits.MaxFileSize)
+	assert.Nil(t, ioutil.WriteFile("../test18", []byte(RandStringBytesMaskImprSrc(20000)), 0755))
+	assert.Nil(t, PatchUp(address, "limituser", "../test18"))
+	assert.True(t, Exists(path.Join(UserHomeDir(), ".patchitup", "server", "limituser", "test18")))
+
+	// a patch that is too large is refused with 413
+	err = uploadPatches(compressPatch(RandStringBytesMaskImprSrc(20000)), address, "limituser", "../test18", "", "")
+	assert.Equal(t, errTooLarge, errors.Cause(err))
+
+	// files can not grow beyond the limit
+	assert.Nil(t, ioutil.WriteFile("../test18", []byte(RandStringBytesMaskImprSrc(60000)), 0755))
+	err = PatchUp(address, "limituser", "../test18")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "larger than the limit")
+	assert.NotNil(t, checkFileSize(60000))
+	assert.Nil(t, checkFileSize(40000))
+
+	// requests over the rate of their user are refused with 429, which the
+	// client waits out
+	assert.Nil(t, ioutil.WriteFile(pathToLimits(), []byte("UserRate = 5\nUserBurst = 1\n"), 0755))
+	assert.Nil(t, loadLimits(nil))
+	body := []byte(`{"username":"limituser","filename":"test18"}`)
+	post := func(sign bool) []int {
+		statuses := []int{}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", address+"/fileHash", bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentTypeJSON)
+			if sign {
+				assert.Nil(t, signRequest(req, "limituser", body))
+			}
+			resp, err := httpClient.Do(req)
+			assert.Nil(t, err)
+			resp.Body.Close()
+			statuses = append(statuses, resp.StatusCode)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+			}
+		}
+		return statuses
+	}
+	// the user is not known without a signature, so only the rate of the
+	// address applies
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, post(false))
+	assert.Nil(t, loadSecrets(map[string]string{"limituser": "s3cret"}))
+	defer loadSecrets(nil)
+	setClientSecret(clientConfiguration{ServerAddress: address, Username: "limituser", Secret: "s3cret"})
+	defer delete(clientSecrets.secrets, clientSecret{address, "limituser"})
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, post(true))
+	for i := 0; i < 3; i++ {
+		_, err = ListRevisions(address, "limituser", "../test18")
+		assert.Nil(t, err)
+	}
+}
+
+func TestServerConfiguration(t *testing.T) {
+	SetLogLevel("info")
+	folder, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	pathToConfig := path.Join(folder, "server.toml")
+	writeConfig := func(extra string) {
+		assert.Nil(t, ioutil.WriteFile(pathToConfig, []byte(fmt.Sprintf("Listen = \":9999\"\nDataDir = %q\n%s\n[Retention]\nKeep = 2\n", path.Join(folder, "data"), extra)), 0755))
+	}
+	writeConfig("[Limits]\nMaxFileSize = 1000")
+	SetServerConfiguration(pathToConfig)
+	defer SetServerConfiguration("")
+
+	// the environment overrides the file
+	os.Setenv("PATCHITUP_LISTEN", ":8016")
+	defer os.Unsetenv("PATCHITUP_LISTEN")
+	config, err := loadServerConfiguration()
+	assert.Nil(t, err)
+	assert.Equal(t, ":8016", config.Listen)
+	assert.Equal(t, path.Join(folder, "data"), config.DataDir)
+	assert.Equal(t, int64(defaultMaxBodySize), config.Limits.MaxBodySize)
+	assert.Equal(t, int64(1000), config.Limits.MaxFileSize)
+	assert.Equal(t, 2, config.Retention.Keep)
+
+	defer func() {
+		setServerDataDir("")
+		loadLimits(nil)
+		setRetention(retentionConfiguration{})
+	}()
+	go func() {
+		err := Run("")
+		assert.Nil(t, err)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	address := "http://localhost:8016"
+	defer os.Remove("../test19")
+
+	// the files are kept in the data folder
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, ioutil.WriteFile("../test19", []byte(strings.Repeat("configured\n", i)), 0755))
+		assert.Nil(t, PatchUp(address, "confuser", "../test19"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.True(t, Exists(path.Join(folder, "data", "confuser", "test19")))
+	assert.Nil(t, ioutil.WriteFile("../test19", []byte(strings.Repeat("configured\n", 100)), 0755))
+	err = PatchUp(address, "confuser", "../test19")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "larger than the limit")
+
+	// old revisions are pruned past the retention
+	pruned, err := applyRetention(getRetention())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+	revisions, err := ListRevisions(address, "confuser", "../test19")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+
+	// the configuration is reloaded on SIGHUP
+	writeConfig("[Limits]\nMaxFileSize = 5000")
+	p, err := os.FindProcess(os.Getpid())
+	assert.Nil(t, err)
+	assert.Nil(t, p.Signal(syscall.SIGHUP))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(5000), getLimits().MaxFileSize)
+
+	// a configuration that is not valid is not applied
+	writeConfig("LogLevel = \"loud\"")
+	assert.NotNil(t, reloadServerConfiguration(config))
+	assert.Equal(t, int64(5000), getLimits().MaxFileSize)
+	// nor is any part of a configuration with a part that is not valid
+	writeConfig("[Limits]\nMaxFileSize = 6000")
+	assert.Nil(t, ioutil.WriteFile(pathToWebhooks(), []byte("[[Webhook]]\n"), 0644))
+	assert.NotNil(t, reloadServerConfiguration(config))
+	assert.Equal(t, int64(5000), getLimits().MaxFileSize)
+	assert.Nil(t, os.Remove(pathToWebhooks()))
+	writeConfig("Lisen = \":8002\"")
+	_, err = loadServerConfiguration()
+	assert.NotNil(t, err)
+	writeConfig("")
+	os.Setenv("PATCHITUP_MAX_FILE_SIZE", "big")
+	defer os.Unsetenv("PATCHITUP_MAX_FILE_SIZE")
+	_, err = loadServerConfiguration()
+	assert.NotNil(t, err)
+}
+
+func TestWebUI(t *testing.T) {
+	SetLogLevel("info")
+	folder, err := ioutil.TempDir("", "patchitup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	defer os.Remove("../test20")
+	for i := 1; i <= 2; i++ {
+		assert.Nil(t, ioutil.WriteFile("../test20", []byte(fmt.Sprintf("<b>version %d</b>\n", i)), 0755))
+		assert.Nil(t, PatchUp("file://"+folder, "uiuser", "../test20"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	revisions, err := ListRevisions("file://"+folder, "uiuser", "../test20")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+
+	defer func() {
+		setUI(uiConfiguration{})
+		loadSecrets(nil)
+	}()
+	setUI(uiConfiguration{
+		Users:  map[string]string{"uiuser": "s3cret", "otheruser": "other"},
+		Admins: map[string]string{"admin": "password"},
+	})
+	assert.Nil(t, loadSecrets(map[string]string{"uiuser": "signing"}))
+	router := newRouter(folder)
+	get := func(url, username, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.TLS = &tls.ConnectionState{}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// the web UI is only served over TLS
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ui/", nil)
+	req.SetBasicAuth("uiuser", "s3cret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// only those who sign in see anything, and users only see their own files
+	w = get("/ui/", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+	assert.Equal(t, http.StatusUnauthorized, get("/ui/", "uiuser", "wrong").Code)
+	// the secret that requests are signed with is not a password
+	assert.Equal(t, http.StatusUnauthorized, get("/ui/", "uiuser", "signing").Code)
+	w = get("/ui/", "uiuser", "s3cret")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/ui/uiuser/", w.Header().Get("Location"))
+	assert.Equal(t, http.StatusForbidden, get("/ui/uiuser/", "otheruser", "other").Code)
+
+	w = get("/ui/", "admin", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href="/ui/uiuser/"`)
+	w = get("/ui/uiuser/", "uiuser", "s3cret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href="/ui/uiuser/test20"`)
+	w = get("/ui/uiuser/test20", "uiuser", "s3cret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf("diff?from=%d&amp;to=%d", revisions[0], revisions[1]))
+	assert.Equal(t, http.StatusNotFound, get("/ui/uiuser/nothing", "uiuser", "s3cret").Code)
+
+	// diffs are rendered with the text of the file escaped
+	w = get(fmt.Sprintf("/ui/uiuser/test20/diff?from=%d&to=%d", revisions[0], revisions[1]), "admin", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<span class="add">&#43;&lt;b&gt;version 2&lt;/b&gt;</span>`)
+	assert.NotContains(t, w.Body.String(), "<b>version")
+
+	// any revision can be downloaded
+	w = get(fmt.Sprintf("/ui/uiuser/test20/download?revision=%d", revisions[0]), "uiuser", "s3cret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<b>version 1</b>\n", w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+	assert.True(t, getBandwidthOf("uiuser").Sent > 0)
+	assert.Equal(t, 0, getBandwidthOf("otheruser").Requests)
+}
+
+func TestReconstructionSavings(t *testing.T) {
+	// the local file is the remote file with some lines changed
+	var remoteLines, localLines []string
+	for i := 0; i < 100000; i++ {
+		line := fmt.Sprintf("INSERT INTO data VALUES(%d,'%s');", i, RandStringBytesMaskImprSrc(20))
+		remoteLines = append(remoteLines, line)
+		if i%20 == 0 {
+			line = RandStringBytesMaskImprSrc(40)
+		}
+		localLines = append(localLines, line)
+	}
+	assert.Nil(t, ioutil.WriteFile("../test5.remote", []byte(strings.Join(remoteLines, "\n")), 0755))
+	defer os.Remove("../test5.remote")
+	assert.Nil(t, ioutil.WriteFile("../test5.local", []byte(strings.Join(localLines, "\n")), 0755))
+	defer os.Remove("../test5.local")
+	localHashLines, err := getHashLines("../test5.local")
+	assert.Nil(t, err)
+
+	// line numbers, then the missing lines
+	hashLineNumbers, err := getHashLineNumbers("../test5.remote")
+	assert.Nil(t, err)
+	remoteHashLines, err := getHashLines("../test5.remote")
+	assert.Nil(t, err)
+	missingLines := make(map[string]struct{})
+	missingLineText := make(map[string][]byte)
+	for h := range hashLineNumbers {
+		if _, ok := localHashLines[h]; !ok {
+			missingLines[h] = struct{}{}
+			missingLineText[h] = remoteHashLines[h]
+		}
+	}
+	b1, _ := json.Marshal(serverResponse{HashLinenumbers: hashLineNumbers})
+	b2, _ := json.Marshal(serverRequest{MissingLines: missingLines})
+	b3, _ := json.Marshal(serverResponse{HashLineText: missingLineText})
+	lineNumbersSize := len(b1) + len(b2) + len(b3)
+
+	// filter, then the missing lines with the line order
+	filter := newBloomFilter(len(localHashLines), bloomFalsePositiveRate)
+	for h := range localHashLines {
+		filter.add(h)
+	}
+	dictionary, lineOrder, lines, err := getReconstruction("../test5.remote", filter)
+	assert.Nil(t, err)
+	// filters that would make the server panic or run out of memory are
+	// refused
+	for _, bad := range []*bloomFilter{{Bits: filter.Bits, K: -1}, {Bits: filter.Bits, K: 1 << 30}, {K: 3}, {Bits: make([]byte, maxBloomSize+1), K: 3}} {
+		_, _, _, err = getReconstruction("../test5.remote", bad)
+		assert.NotNil(t, err)
+	}
+	assert.True(t, len(lines) <= len(missingLines))
+	b1, _ = json.Marshal(serverRequest{Filter: filter})
+	b2, _ = json.Marshal(serverResponse{Dictionary: dictionary, LineOrder: lineOrder, HashLineText: lines})
+	filterSize := len(b1) + len(b2)
+
+	t.Logf("line numbers: %s, filter: %s (%2.1f%% saved)", humanize.Bytes(uint64(lineNumbersSize)), humanize.Bytes(uint64(filterSize)), 100-100*float64(filterSize)/float64(lineNumbersSize))
+	assert.True(t, filterSize < lineNumbersSize)
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	// a small change to a SQL dump
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf("INSERT INTO users (id, name, email, created_at) VALUES (%d, '%s', '%s@example.com', '2018-01-%02d 12:00:00');", i, RandStringBytesMaskImprSrc(8), RandStringBytesMaskImprSrc(8), i%28+1))
+	}
+	text := strings.Join(lines, "\n")
+	for i := 5000; i < 5010; i++ {
+		lines = append(lines, fmt.Sprintf("INSERT INTO users (id, name, email, created_at) VALUES (%d, '%s', '%s@example.com', '2018-02-01 12:00:00');", i, RandStringBytesMaskImprSrc(8), RandStringBytesMaskImprSrc(8)))
+	}
+	patchText := getPatchText(text, strings.Join(lines, "\n"))
+
+	dictionary, id, err := trainDictionary(text)
+	assert.Nil(t, err)
+	assert.Nil(t, saveDictionary(pathToServerDictionary(pathToCacheServer, id), dictionary))
+	withDictionary, err := getCodec("zstd", id)
+	assert.Nil(t, err)
+
+	sizes := make(map[string]int)
+	for _, c := range []codec{gzipCodec{}, zstdCodec{}, brotliCodec{}, noneCodec{}, withDictionary} {
+		patch, err := compressPatchWith(patchText, c, dmpDiffer{})
+		assert.Nil(t, err)
+		name := patchHeader(c, dmpDiffer{})
+		sizes[name] = len(patch)
+		t.Logf("%s: %d bytes", name, len(patch))
+
+		// every codec decompresses to the same patch
+		decompressed, err := decompressPatch(patch)
+		assert.Nil(t, err)
+		assert.Equal(t, patchText, decompressed)
+	}
+	assert.True(t, sizes[patchHeader(withDictionary, dmpDiffer{})] < sizes[""])
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	setLimits(limitsConfiguration{MaxFileSize: 1000})
+	defer loadLimits(nil)
+
+	// a few kilobytes that inflate to more than the limit allows
+	patchText := getPatchText("", strings.Repeat("a", 10*1024*1024))
+	for _, c := range []codec{gzipCodec{}, zstdCodec{}, brotliCodec{}} {
+		patch, err := compressPatchWith(patchText, c, dmpDiffer{})
+		assert.Nil(t, err)
+		assert.True(t, len(patch) < 1024*1024)
+		_, err = decompressPatch(patch)
+		assert.NotNil(t, err, c.Name())
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	sr := serverResponse{
+		Message:         "ok",
+		Success:         true,
+		HashLinenumbers: lineNumbers{"abcdefgh": {0, 5, 1000000}, "12345678": {3}},
+		HashLineText:    map[string][]byte{"abcdefgh": []byte("line")},
+		Data:            base64String(getPatch("", "hello\nworld\n")),
+	}
+	bJSON, err := json.Marshal(sr)
+	assert.Nil(t, err)
+	bBinary, err := cbor.Marshal(sr)
+	assert.Nil(t, err)
+	assert.True(t, len(bBinary) < len(bJSON))
+
+	var decoded serverResponse
+	assert.Nil(t, cbor.Unmarshal(bBinary, &decoded))
+	assert.Equal(t, sr, decoded)
+
+	// strings that are not base64 are sent as is
+	sr = serverResponse{Data: "--- a\n+++ b\n"}
+	bBinary, err = cbor.Marshal(sr)
+	assert.Nil(t, err)
+	decoded = serverResponse{}
+	assert.Nil(t, cbor.Unmarshal(bBinary, &decoded))
+	assert.Equal(t, sr, decoded)
+}
+
+func TestLegacyServer(t *testing.T) {
+	SetLogLevel("info")
+	// a server that only speaks protocol version 1
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(dataDirKey, pathToCacheServer) })
+	r.POST("/lineNumbers", handlerLineNumbers)
+	r.POST("/lineText", handlerLineText)
+	r.POST("/patch", handlerPatch)
+	r.POST("/fileHash", handlerFileHash)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	caps, err := getCapabilities(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, caps.ProtocolVersion)
+
+	os.RemoveAll(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test6"))
+	err = CopyFile("client.go", "../test6")
+	assert.Nil(t, err)
+	defer os.Remove("../test6")
+	err = PatchUp(ts.URL, "testuser", "../test6")
+	assert.Nil(t, err)
+
+	// reconstructs using line numbers
+	os.Remove(pathToCachedCopy(ts.URL, "testuser", "test6"))
+	err = CopyFile("server.go", "../test6")
+	assert.Nil(t, err)
+	err = PatchUp(ts.URL, "testuser", "../test6")
+	assert.Nil(t, err)
+	originalHash, err := Filemd5Sum("../test6")
+	assert.Nil(t, err)
+	serverHash, err := Filemd5Sum(path.Join(UserHomeDir(), ".patchitup", "server", "testuser", "test6"))
+	assert.Nil(t, err)
+	assert.Equal(t, originalHash, serverHash)
+
+	_, err = ListRevisions(ts.URL, "testuser", "../test6")
+	assert.NotNil(t, err)
 }
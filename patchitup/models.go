@@ -9,17 +9,50 @@ import (
 
 type serverRequest struct {
 	Username     string              `json:"username" binding:"required"`
-	Filename     string              `json:"filename" binding:"required"`
-	Data         string              `json:"data"`
+	Filename     string              `json:"filename"`
+	Data         base64String        `json:"data"`
 	MissingLines map[string]struct{} `json:"missing_lines"`
-	Patch        string              `json:"patch"`
+	Patch        base64String        `json:"patch"`
+	From         string              `json:"from,omitempty"`
+	To           string              `json:"to,omitempty"`
+	Format       string              `json:"format,omitempty"`
+	At           string              `json:"at,omitempty"`
+	Session      string              `json:"session,omitempty"`
+	Chunk        int                 `json:"chunk,omitempty"`
+	Checksum     string              `json:"checksum,omitempty"`
+	Size         int                 `json:"size,omitempty"`
+	Filter       *bloomFilter        `json:"filter,omitempty"`
+	DictionaryID string              `json:"dictionary_id,omitempty"`
+	Files        []commitFile        `json:"files,omitempty"`
+	Message      string              `json:"message,omitempty"`
+	Commit       string              `json:"commit,omitempty"`
+	Tag          string              `json:"tag,omitempty"`
+	Keep         int                 `json:"keep,omitempty"`
+	Revision     int64               `json:"revision,omitempty"`
+	Replica      []replicaRevision   `json:"replica,omitempty"`
+	Full         bool                `json:"full,omitempty"`
+	Bundle       *bundle             `json:"bundle,omitempty"`
 }
 
 type serverResponse struct {
 	Message         string            `json:"message"`
 	Success         bool              `json:"success"`
-	HashLinenumbers map[string][]int  `json:"hash_linenumbers"`
+	HashLinenumbers lineNumbers       `json:"hash_linenumbers"`
 	HashLineText    map[string][]byte `json:"hash_linetext"`
+	Data            base64String      `json:"data,omitempty"`
+	Revisions       []int64           `json:"revisions,omitempty"`
+	Hunks           []diffHunk        `json:"hunks,omitempty"`
+	Revision        int64             `json:"revision,omitempty"`
+	Session         string            `json:"session,omitempty"`
+	Chunks          []int             `json:"chunks,omitempty"`
+	Dictionary      []byte            `json:"dictionary,omitempty"`
+	LineOrder       []byte            `json:"line_order,omitempty"`
+	DictionaryID    string            `json:"dictionary_id,omitempty"`
+	Commit          string            `json:"commit,omitempty"`
+	Commits         []CommitInfo      `json:"commits,omitempty"`
+	Tags            []TagInfo         `json:"tags,omitempty"`
+	Deliveries      []webhookDelivery `json:"deliveries,omitempty"`
+	Replica         []replicaRevision `json:"replica,omitempty"`
 }
 
 var convertWindowsLineFeed = regexp.MustCompile(`\r?\n`)
@@ -1,67 +1,158 @@
 package patchitup
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/base64"
-	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
-	log "github.com/cihub/seelog"
-	"github.com/dustin/go-humanize"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 func getPatch(text1, text2 string) string {
+	return compressPatch(getPatchText(text1, text2))
+}
+
+// getPatchText returns the human-readable patch that turns text1 into text2.
+func getPatchText(text1, text2 string) string {
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(text1, text2, false)
 	patches := dmp.PatchMake(text1, diffs)
-	patchUncompressed := dmp.PatchToText(patches)
+	return dmp.PatchToText(patches)
+}
 
-	// compress patch
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	if _, err := gz.Write([]byte(patchUncompressed)); err != nil {
+// compressPatch gzips and base64 encodes the patch text for transport.
+func compressPatch(patchUncompressed string) string {
+	compressedPatch, err := compressPatchWith(patchUncompressed, gzipCodec{}, dmpDiffer{})
+	if err != nil {
 		panic(err)
 	}
-	if err := gz.Flush(); err != nil {
-		panic(err)
+	return compressedPatch
+}
+
+func patchFile(pathToFile string, compressedPatch string) (err error) {
+	newText, err := getPatchedText(pathToFile, compressedPatch)
+	if err != nil {
+		return
 	}
-	if err := gz.Close(); err != nil {
-		panic(err)
+	pathToTemp, err := stagePatchedText(pathToFile, newText)
+	if err != nil {
+		return
 	}
-	compressedPatch := base64.StdEncoding.EncodeToString(b.Bytes())
+	return commitPatchedText(pathToFile, pathToTemp, compressedPatch, time.Now().UnixNano()/1000000)
+}
 
-	log.Debugf("compressed patch from %s to %s", humanize.Bytes(uint64(len(patchUncompressed))), humanize.Bytes(uint64(len(compressedPatch))))
-	return compressedPatch
+// getPatchedText returns the text of the file with the patch applied, where
+// a file that does not exist yet is empty.
+func getPatchedText(pathToFile string, compressedPatch string) (newText string, err error) {
+	patch, d, err := readPatch(compressedPatch)
+	if err != nil {
+		return
+	}
+	textBase := ""
+	if Exists(pathToFile) {
+		textBase, err = getFileText(pathToFile)
+		if err != nil {
+			return
+		}
+	}
+	newText, err = d.Apply(textBase, patch)
+	if err != nil {
+		return
+	}
+	err = checkFileSize(len(newText))
+	return
 }
 
-func patchFile(pathToFile string, compressedPatch string) (err error) {
-	// decompress patch
-	compressedPatchBytes, err := base64.StdEncoding.DecodeString(compressedPatch)
+// stagePatchedText writes the new text of a file next to it, so that it
+// can replace the file atomically.
+func stagePatchedText(pathToFile, newText string) (pathToTemp string, err error) {
+	folder, filename := filepath.Split(pathToFile)
+	pathToTemp = filepath.Join(folder, "."+filename+".temp")
+	err = ioutil.WriteFile(pathToTemp, []byte(newText), 0755)
+	return
+}
+
+// commitPatchedText replaces the file with its staged text and keeps the
+// patch as the given revision.
+func commitPatchedText(pathToFile, pathToTemp, compressedPatch string, revision int64) (err error) {
+	err = os.Rename(pathToTemp, pathToFile)
 	if err != nil {
 		return
 	}
-	gr, err := gzip.NewReader(bytes.NewBuffer(compressedPatchBytes))
-	defer gr.Close()
-	data, err := ioutil.ReadAll(gr)
+	err = ioutil.WriteFile(pathToRevision(pathToFile, revision), []byte(compressedPatch), 0755)
+	return
+}
+
+// keepOriginal links the file to a path next to it before it is replaced,
+// so that it can be put back. The path is empty if there is no file yet.
+func keepOriginal(pathToFile string) (pathToOriginal string, err error) {
+	if !Exists(pathToFile) {
+		return
+	}
+	folder, filename := filepath.Split(pathToFile)
+	pathToOriginal = filepath.Join(folder, "."+filename+".orig")
+	os.Remove(pathToOriginal)
+	if os.Link(pathToFile, pathToOriginal) != nil {
+		// the file system does not have hard links
+		err = CopyFile(pathToFile, pathToOriginal)
+	}
+	return
+}
+
+// rollbackPatchedText undoes commitPatchedText, putting back the original
+// file and removing the revision.
+func rollbackPatchedText(pathToFile, pathToOriginal string, revision int64) (err error) {
+	os.Remove(pathToRevision(pathToFile, revision))
+	if pathToOriginal == "" {
+		err = os.Remove(pathToFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return os.Rename(pathToOriginal, pathToFile)
+}
+
+// decompressPatch returns the patch text from a compressed patch.
+func decompressPatch(compressedPatch string) (patch string, err error) {
+	header, body := parsePatchHeader(compressedPatch)
+	c, err := getCodec(header["codec"], header["dict"])
+	if err != nil {
+		return
+	}
+	compressedPatchBytes, err := base64.StdEncoding.DecodeString(body)
 	if err != nil {
-		return err
+		return
 	}
-	patch := string(data)
+	data, err := c.Decompress(compressedPatchBytes)
+	if err != nil {
+		return
+	}
+	patch = string(data)
+	return
+}
 
-	dmp := diffmatchpatch.New()
-	patches, err := dmp.PatchFromText(patch)
+// readPatch returns the patch text from a compressed patch along with the
+// diff algorithm that applies it.
+func readPatch(compressedPatch string) (patch string, d differ, err error) {
+	header, _ := parsePatchHeader(compressedPatch)
+	d, err = getDiffer(header["diff"])
 	if err != nil {
 		return
 	}
-	textBase, err := getFileText(pathToFile)
+	patch, err = decompressPatch(compressedPatch)
+	return
+}
+
+// applyPatch applies the patch text to the text.
+func applyPatch(text, patch string) (newText string, err error) {
+	dmp := diffmatchpatch.New()
+	patches, err := dmp.PatchFromText(patch)
 	if err != nil {
 		return
 	}
-	newText, _ := dmp.PatchApply(patches, textBase)
-	err = ioutil.WriteFile(pathToFile, []byte(newText), 0755)
-	err = ioutil.WriteFile(fmt.Sprintf("%s.%d", pathToFile, time.Now().UnixNano()/1000000), []byte(compressedPatch), 0755)
+	newText, _ = dmp.PatchApply(patches, text)
 	return
 }
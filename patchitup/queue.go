@@ -0,0 +1,108 @@
+package patchitup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// When the server can not be reached, the file is copied into the queue
+// folder so that it can be uploaded the next time PatchUp runs. There is
+// at most one entry for each file on each server, so pending changes to
+// the same file are coalesced into a single upload of its latest state.
+
+// queueEntry is an upload waiting in the queue
+type queueEntry struct {
+	Address  string    `json:"address"`
+	Username string    `json:"username"`
+	Filename string    `json:"filename"`
+	Queued   time.Time `json:"queued"`
+	// Tag and Message are the tag of the upload when it was queued
+	Tag     string `json:"tag,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func pathToQueue() string {
+	return path.Join(pathToCacheClient, "queue")
+}
+
+// queueKey is the name of the queue entry for a file on a server
+func queueKey(address, username, filename string) string {
+	return checksum([]byte(address + "/" + username + "/" + filename))[:16]
+}
+
+// addToQueue records the current state of a file to upload it later, with
+// the tag of the upload.
+func addToQueue(address, username, pathToFile, filename string, opts Options) (err error) {
+	os.MkdirAll(pathToQueue(), 0755)
+	key := path.Join(pathToQueue(), queueKey(address, username, filename))
+	err = CopyFile(pathToFile, key+".data")
+	if err != nil {
+		return
+	}
+	bEntry, _ := json.Marshal(queueEntry{
+		Address:  address,
+		Username: username,
+		Filename: filename,
+		Queued:   time.Now(),
+		Tag:      opts.Tag,
+		Message:  opts.Message,
+	})
+	err = ioutil.WriteFile(key+".json", bEntry, 0755)
+	return
+}
+
+// removeFromQueue removes the queue entry for a file, if there is one.
+func removeFromQueue(address, username, filename string) {
+	key := path.Join(pathToQueue(), queueKey(address, username, filename))
+	os.Remove(key + ".json")
+	os.Remove(key + ".data")
+}
+
+// flushQueue uploads the queued files, each with its own tag. It stops at
+// the first server that is still unreachable and keeps the rest of the
+// queue.
+func flushQueue(opts Options) (err error) {
+	files, err := ioutil.ReadDir(pathToQueue())
+	if err != nil {
+		// nothing queued
+		err = nil
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		key := path.Join(pathToQueue(), strings.TrimSuffix(f.Name(), ".json"))
+		bEntry, errRead := ioutil.ReadFile(key + ".json")
+		if errRead != nil {
+			continue
+		}
+		var entry queueEntry
+		if errRead = json.Unmarshal(bEntry, &entry); errRead != nil {
+			log.Warnf("removing unreadable queue entry %s", f.Name())
+			os.Remove(key + ".json")
+			os.Remove(key + ".data")
+			continue
+		}
+
+		log.Infof("uploading '%s' queued at %s", entry.Filename, entry.Queued.Format(time.RFC3339))
+		entryOpts := opts
+		entryOpts.Tag, entryOpts.Message = entry.Tag, entry.Message
+		err = patchUp(entry.Address, entry.Username, key+".data", entry.Filename, entryOpts)
+		if isUnreachable(err) {
+			return
+		} else if err != nil {
+			log.Errorf("could not upload queued '%s': %s", entry.Filename, err)
+		}
+		os.Remove(key + ".json")
+		os.Remove(key + ".data")
+	}
+	err = nil
+	return
+}
@@ -0,0 +1,186 @@
+package patchitup
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Instead of downloading the line numbers of every line hash, the client
+// can send a Bloom filter of the hashes of its own lines. The server then
+// responds with only the lines the client is missing, along with
+//
+//   - a dictionary of the (raw) hashes of every distinct line, in order of
+//     first appearance, and
+//   - the line order, a uvarint per line that is 0 for a line that appears
+//     for the first time and otherwise one more than its dictionary index.
+//
+// Lines that the client is missing because of a false positive of the
+// filter are fetched afterwards using /lineText.
+
+// bloomFalsePositiveRate is the false positive rate of the client's filter
+const bloomFalsePositiveRate = 0.01
+
+// hashSize is the number of raw bytes of a line hash (see HashSHA256)
+const hashSize = 6
+
+// getReconstruction describes a file for a client whose lines are in the filter.
+func getReconstruction(pathToFile string, filter *bloomFilter) (dictionary, lineOrder []byte, missingLines map[string][]byte, err error) {
+	if filter != nil {
+		err = filter.validate()
+		if err != nil {
+			return
+		}
+	}
+	missingLines = make(map[string][]byte)
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	index := make(map[string]uint64)
+	buf := make([]byte, binary.MaxVarintLen64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := convertWindowsLineFeed.ReplaceAll(scanner.Bytes(), []byte("\n"))
+		h := HashSHA256(line)
+		i, ok := index[h]
+		if ok {
+			lineOrder = append(lineOrder, buf[:binary.PutUvarint(buf, i+1)]...)
+			continue
+		}
+		index[h] = uint64(len(index))
+		lineOrder = append(lineOrder, 0)
+		rawHash, _ := base64.StdEncoding.DecodeString(h)
+		dictionary = append(dictionary, rawHash...)
+		if filter == nil || !filter.has(h) {
+			missingLines[h] = line
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func handlerReconstruct(c *gin.Context) {
+	dictionary, lineOrder, lines, message, err := func(c *gin.Context) (dictionary, lineOrder []byte, lines map[string][]byte, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s upload: %s", sr.Username, sr.Filename, humanize.Bytes(uint64(c.Request.ContentLength)))
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		dictionary, lineOrder, lines, err = getReconstruction(pathToFile, sr.Filter)
+		message = fmt.Sprintf("sending %d of %d lines", len(lines), len(dictionary)/hashSize)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:      message,
+		Success:      err == nil,
+		HashLineText: lines,
+		Dictionary:   dictionary,
+		LineOrder:    lineOrder,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// reconstructWithFilter rebuilds the remote copy of a file by sending a
+// Bloom filter of the local lines.
+func reconstructWithFilter(address, username, filename, pathToLocalCopy string) (reconstructedFile string, linesFetched int, err error) {
+	hashLines, err := getHashLines(pathToLocalCopy)
+	if err != nil {
+		return
+	}
+	filter := newBloomFilter(len(hashLines), bloomFalsePositiveRate)
+	for h := range hashLines {
+		filter.add(h)
+	}
+
+	target, err := postToServerRetry(address+"/reconstruct", serverRequest{
+		Username: username,
+		Filename: filename,
+		Filter:   filter,
+	})
+	if err != nil {
+		return
+	}
+	linesFetched = len(target.HashLineText)
+	for h := range target.HashLineText {
+		hashLines[h] = target.HashLineText[h]
+	}
+
+	if len(target.Dictionary)%hashSize != 0 {
+		err = errors.New("malformed dictionary")
+		return
+	}
+	hashes := make([]string, len(target.Dictionary)/hashSize)
+	missingLines := make(map[string]struct{})
+	for i := range hashes {
+		hashes[i] = base64.StdEncoding.EncodeToString(target.Dictionary[i*hashSize : (i+1)*hashSize])
+		if _, ok := hashLines[hashes[i]]; !ok {
+			missingLines[hashes[i]] = struct{}{}
+		}
+	}
+
+	// fetch lines that were missed because of false positives
+	if len(missingLines) > 0 {
+		log.Debugf("fetching %d lines missed by the filter", len(missingLines))
+		target2, err2 := postToServerRetry(address+"/lineText", serverRequest{
+			Username:     username,
+			Filename:     filename,
+			MissingLines: missingLines,
+		})
+		if err2 != nil {
+			err = err2
+			return
+		}
+		linesFetched += len(target2.HashLineText)
+		for h := range target2.HashLineText {
+			hashLines[h] = target2.HashLineText[h]
+		}
+	}
+
+	var lines []string
+	next := 0
+	for pos := 0; pos < len(target.LineOrder); {
+		v, n := binary.Uvarint(target.LineOrder[pos:])
+		if n <= 0 {
+			err = errors.New("malformed line order")
+			return
+		}
+		pos += n
+		i := int(v) - 1
+		if v == 0 {
+			i = next
+			next++
+		}
+		if i >= len(hashes) {
+			err = errors.New("malformed line order")
+			return
+		}
+		line, ok := hashLines[hashes[i]]
+		if !ok {
+			err = fmt.Errorf("missing line %s", hashes[i])
+			return
+		}
+		lines = append(lines, string(convertWindowsLineFeed.ReplaceAll(line, []byte("\n"))))
+	}
+	log.Debugf("# lines: %d", len(lines))
+	reconstructedFile = strings.Join(lines, "\n")
+	return
+}
@@ -0,0 +1,731 @@
+package patchitup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// A server can replicate its files to secondary servers, configured in
+// .replication.toml of the primary server:
+//
+//   Replicas = ["http://offsite:8002"]
+//   Secret = "shared by the servers"
+//
+// Every revision applied on the primary server is forwarded to the
+// secondary servers along with the hashes of the file before and after it,
+// and a secondary server only applies a revision on top of the same file.
+// A secondary server is configured with its primary server and the same
+// secret,
+//
+//   Primary = "http://primary:8002"
+//   Secret = "shared by the servers"
+//
+// so that it can catch up on the revisions that it missed, e.g. while it
+// was down, when it starts and every replicationInterval. A file that has
+// changed on the primary server in a way that is not replicated, e.g. it
+// was pruned or deleted and created again, is copied as it is now. The
+// servers sign their requests to each other with the secret, and the
+// replication endpoints are only served when replication is configured.
+// Servers with TLS are connected to like clients connect to them, with CA,
+// Cert and Key in the replication configuration.
+
+// replicationConfig is the replication configuration of a server
+type replicationConfig struct {
+	// Replicas are the secondary servers that revisions are forwarded to
+	Replicas []string `toml:",omitempty"`
+	// Primary is the server that this server is a secondary server of
+	Primary string `toml:",omitempty"`
+	// Secret is shared by the primary server and its secondary servers,
+	// which sign their requests to each other with it
+	Secret string `toml:",omitempty"`
+	// CA is the certificate authority that the certificates of the other
+	// servers are pinned to
+	CA string `toml:",omitempty"`
+	// Cert and Key are the certificate of this server, if the other servers
+	// require one
+	Cert string `toml:",omitempty"`
+	Key  string `toml:",omitempty"`
+
+	// tls are the TLS configurations of the other servers, by host
+	tls map[string]*tls.Config
+}
+
+// enabled returns whether the server is a primary or secondary server.
+func (config replicationConfig) enabled() bool {
+	return len(config.Replicas) > 0 || config.Primary != ""
+}
+
+// peers returns the addresses of the other servers.
+func (config replicationConfig) peers() (peers []string) {
+	peers = append(peers, config.Replicas...)
+	if config.Primary != "" {
+		peers = append(peers, config.Primary)
+	}
+	return
+}
+
+// replicationSigner is who the requests between servers are signed by,
+// which is not a valid username
+const replicationSigner = ".replication"
+
+// replicationClient is the client that servers replicate with
+var replicationClient = &http.Client{
+	Timeout:   60 * time.Second,
+	Transport: newClientTransport(),
+}
+
+// outOfSyncError is returned when a revision does not apply on top of the
+// file on a secondary server
+type outOfSyncError struct {
+	err error
+}
+
+func (e outOfSyncError) Error() string {
+	return e.err.Error()
+}
+
+// replicaRevision is a revision of a file sent to a secondary server
+type replicaRevision struct {
+	Revision int64        `json:"revision"`
+	Patch    base64String `json:"patch"`
+	// BaseHash is the hash of the file before the revision, and Hash after it
+	BaseHash string `json:"base_hash"`
+	Hash     string `json:"hash"`
+}
+
+// replicaFile is the latest revision of a file on the primary server
+type replicaFile struct {
+	Username string `json:"username"`
+	Filename string `json:"filename"`
+	Revision int64  `json:"revision"`
+	Hash     string `json:"hash"`
+}
+
+// replicationInterval is how often a secondary server catches up with its
+// primary server
+var replicationInterval = 5 * time.Minute
+
+var replication = struct {
+	sync.RWMutex
+	config replicationConfig
+}{}
+
+var startReplicationOnce sync.Once
+
+func pathToReplication() string {
+	return path.Join(getServerDataDir(), ".replication.toml")
+}
+
+// loadReplication loads the replication configuration of the server.
+func loadReplication() (err error) {
+	config, err := readReplication()
+	if err != nil {
+		return
+	}
+	setReplication(config)
+	return
+}
+
+// readReplication reads the replication configuration of the server.
+func readReplication() (config replicationConfig, err error) {
+	if Exists(pathToReplication()) {
+		_, err = toml.DecodeFile(pathToReplication(), &config)
+		if err != nil {
+			return
+		}
+	}
+	for i := range config.Replicas {
+		config.Replicas[i] = strings.TrimRight(config.Replicas[i], "/")
+	}
+	config.Primary = strings.TrimRight(config.Primary, "/")
+	if config.enabled() && config.Secret == "" {
+		err = fmt.Errorf("replication needs a Secret in %s", pathToReplication())
+		return
+	}
+	if config.CA == "" && config.Cert == "" {
+		return
+	}
+	config.tls = make(map[string]*tls.Config)
+	for _, peer := range config.peers() {
+		host, tlsConfig, errTLS := clientTLSConfig(clientConfiguration{
+			ServerAddress: peer,
+			CA:            config.CA,
+			Cert:          config.Cert,
+			Key:           config.Key,
+		})
+		if errTLS != nil {
+			err = errors.Wrapf(errTLS, "problem with replication TLS")
+			return
+		}
+		config.tls[host] = tlsConfig
+	}
+	return
+}
+
+func setReplication(config replicationConfig) {
+	replication.Lock()
+	replication.config = config
+	replication.Unlock()
+	for host, tlsConfig := range config.tls {
+		setHostTLS(host, tlsConfig)
+	}
+	if len(config.Replicas) > 0 {
+		log.Infof("replicating to %s", strings.Join(config.Replicas, ", "))
+	}
+	if config.Primary != "" {
+		log.Infof("replicating from %s", config.Primary)
+	}
+}
+
+func getReplication() replicationConfig {
+	replication.RLock()
+	defer replication.RUnlock()
+	return replication.config
+}
+
+// startReplication forwards the revisions of every user to the secondary
+// servers, and catches up with the primary server.
+func startReplication() {
+	startReplicationOnce.Do(func() {
+		ch := events.subscribe(getServerDataDir(), "")
+		go func() {
+			// the revisions are forwarded to each secondary server in order
+			queues := make(map[string]chan Event)
+			for e := range ch {
+				if e.Type != EventPatch && e.Type != EventCreate {
+					continue
+				}
+				for _, replica := range getReplication().Replicas {
+					queue, ok := queues[replica]
+					if !ok {
+						queue = make(chan Event, eventBuffer)
+						queues[replica] = queue
+						go forwardRevisions(replica, queue)
+					}
+					select {
+					case queue <- e:
+					default:
+						log.Warnf("%s is not keeping up, it will catch up on revision %d of '%s' of '%s'", replica, e.Revision, e.Filename, e.Username)
+					}
+				}
+			}
+		}()
+		go func() {
+			for {
+				if primary := getReplication().Primary; primary != "" {
+					err := catchUp(primary)
+					if err != nil {
+						log.Warnf("could not catch up with %s: %s", primary, err)
+					}
+				}
+				time.Sleep(replicationInterval)
+			}
+		}()
+	})
+}
+
+// md5Text returns the hash of text, which is the same as the hash of a file
+// with the text (see Filemd5Sum).
+func md5Text(text string) string {
+	hash := md5.Sum([]byte(convertWindowsLineFeed.ReplaceAllString(text, "")))
+	return hex.EncodeToString(hash[:])
+}
+
+// getReplicaRevisions returns the revisions of a file after a revision. The
+// patches are recompressed without dictionaries, which the secondary server
+// does not have.
+func getReplicaRevisions(pathToFile string, after int64) (replicas []replicaRevision, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	text := ""
+	for _, r := range revisions {
+		compressedPatch, errRead := ioutil.ReadFile(pathToRevision(pathToFile, r))
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		patch, d, errPatch := readPatch(string(compressedPatch))
+		if errPatch != nil {
+			err = errors.Wrapf(errPatch, "problem reading revision %d", r)
+			return
+		}
+		baseText := text
+		text, err = d.Apply(text, patch)
+		if err != nil {
+			return
+		}
+		if r <= after {
+			continue
+		}
+		replica := replicaRevision{
+			Revision: r,
+			BaseHash: md5Text(baseText),
+			Hash:     md5Text(text),
+		}
+		var recompressed string
+		recompressed, err = compressPatchWith(patch, gzipCodec{}, d)
+		if err != nil {
+			return
+		}
+		replica.Patch = base64String(recompressed)
+		replicas = append(replicas, replica)
+	}
+	return
+}
+
+// getReplicaRevision returns a revision of a file without its hashes, which
+// the secondary server needs to apply it.
+func getReplicaRevision(pathToFile string, revision int64) (replica replicaRevision, err error) {
+	compressedPatch, err := ioutil.ReadFile(pathToRevision(pathToFile, revision))
+	if err != nil {
+		return
+	}
+	patch, d, err := readPatch(string(compressedPatch))
+	if err != nil {
+		err = errors.Wrapf(err, "problem reading revision %d", revision)
+		return
+	}
+	recompressed, err := compressPatchWith(patch, gzipCodec{}, d)
+	if err != nil {
+		return
+	}
+	replica = replicaRevision{
+		Revision: revision,
+		Patch:    base64String(recompressed),
+	}
+	return
+}
+
+// textHash returns the hash of the text of a file (see md5Text), where a
+// file that does not exist yet is empty.
+func textHash(pathToFile string) string {
+	text, _ := getFileText(pathToFile)
+	return md5Text(text)
+}
+
+// getReplicaSnapshot returns the latest revision of a file as a patch of
+// its whole text, which a secondary server that is out of sync applies
+// instead of the revisions it missed.
+func getReplicaSnapshot(pathToFile string) (replicas []replicaRevision, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	if len(revisions) == 0 {
+		err = fmt.Errorf("no revisions of '%s'", path.Base(pathToFile))
+		return
+	}
+	text, err := getFileText(pathToFile)
+	if err != nil {
+		return
+	}
+	replicas = []replicaRevision{{
+		Revision: revisions[len(revisions)-1],
+		Patch:    base64String(getPatch("", text)),
+		Hash:     md5Text(text),
+	}}
+	return
+}
+
+// listReplicaFiles returns the latest revision of every file of every user
+// in the data folder.
+func listReplicaFiles(folder string) (files []replicaFile, err error) {
+	users, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		if !user.IsDir() || strings.HasPrefix(user.Name(), ".") {
+			continue
+		}
+		entries, errRead := ioutil.ReadDir(path.Join(folder, user.Name()))
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		for _, entry := range entries {
+			revisions, ok := isTrackedFile(path.Join(folder, user.Name()), entry)
+			if !ok {
+				continue
+			}
+			pathToFile := path.Join(folder, user.Name(), entry.Name())
+			f := replicaFile{
+				Username: user.Name(),
+				Filename: entry.Name(),
+				Revision: revisions[len(revisions)-1],
+			}
+			f.Hash, err = Filemd5Sum(pathToFile)
+			if err != nil {
+				return
+			}
+			files = append(files, f)
+		}
+	}
+	return
+}
+
+// applyReplicaRevisions applies the revisions that are newer than the
+// latest revision of the file in the data folder, which must have the base
+// hash of each. A revision without a base hash is a snapshot, which
+// replaces the file unless it is the same.
+func applyReplicaRevisions(folder, username, filename string, replicas []replicaRevision) (applied int, err error) {
+	err = validateNames(username, filename)
+	if err != nil {
+		return
+	}
+	unlock := lockUser(username)
+	defer unlock()
+	os.MkdirAll(path.Join(folder, username), 0755)
+	pathToFile := path.Join(folder, username, filename)
+	for _, replica := range replicas {
+		var latest int64
+		revisions, _ := listRevisions(pathToFile)
+		if len(revisions) > 0 {
+			latest = revisions[len(revisions)-1]
+		}
+		text, hash := "", md5Text("")
+		if Exists(pathToFile) {
+			text, err = getFileText(pathToFile)
+			if err != nil {
+				return
+			}
+			hash = md5Text(text)
+		}
+		var newText, pathToTemp string
+		compressedPatch := string(replica.Patch)
+		if replica.BaseHash == "" {
+			if hash == replica.Hash {
+				continue
+			}
+			newText, err = getPatchedText("", compressedPatch)
+			if err != nil {
+				return
+			}
+			// the snapshot is kept as a revision of the file as it was
+			compressedPatch = getPatch(text, newText)
+			if replica.Revision <= latest {
+				replica.Revision = latest + 1
+			}
+		} else {
+			if replica.Revision <= latest {
+				// already replicated
+				continue
+			}
+			if hash != replica.BaseHash {
+				err = outOfSyncError{fmt.Errorf("'%s' of '%s' is out of sync at revision %d", filename, username, replica.Revision)}
+				return
+			}
+			newText, err = getPatchedText(pathToFile, compressedPatch)
+			if err != nil {
+				return
+			}
+		}
+		if md5Text(newText) != replica.Hash {
+			err = fmt.Errorf("revision %d of '%s' of '%s' does not match", replica.Revision, filename, username)
+			return
+		}
+		pathToTemp, err = stagePatchedText(pathToFile, newText)
+		if err != nil {
+			return
+		}
+		err = commitPatchedText(pathToFile, pathToTemp, compressedPatch, replica.Revision)
+		if err != nil {
+			return
+		}
+		applied++
+		publishPatch(username, filename, pathToFile, hash, len(compressedPatch))
+	}
+	return
+}
+
+// forwardRevisions forwards the revisions of the events to a secondary
+// server, one at a time.
+func forwardRevisions(replica string, queue chan Event) {
+	for e := range queue {
+		forwardRevision(replica, e)
+	}
+}
+
+// forwardRevision sends the revision of the event to a secondary server,
+// which catches up on it by itself if it can not apply it.
+func forwardRevision(replica string, e Event) {
+	pathToFile := path.Join(e.dataDir, e.Username, e.Filename)
+	revision, err := getReplicaRevision(pathToFile, e.Revision)
+	if err != nil {
+		log.Warnf("could not replicate '%s' of '%s': %s", e.Filename, e.Username, err)
+		return
+	}
+	revision.BaseHash = e.baseHash
+	revision.Hash = e.textHash
+	_, err = postToPeer(replica+"/replicate", serverRequest{
+		Username: e.Username,
+		Filename: e.Filename,
+		Replica:  []replicaRevision{revision},
+	})
+	if err != nil {
+		log.Warnf("could not replicate '%s' of '%s' to %s: %s", e.Filename, e.Username, replica, err)
+		return
+	}
+	log.Debugf("replicated revision %d of '%s' of '%s' to %s", e.Revision, e.Filename, e.Username, replica)
+}
+
+// signPeerRequest signs a request to another server with the replication
+// secret.
+func signPeerRequest(req *http.Request, secret string, body []byte) (err error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bNonce := make([]byte, 16)
+	_, err = rand.Read(bNonce)
+	if err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(bNonce)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, signature(secret, replicationSigner, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return
+}
+
+// sendToPeer sends a signed request to a replication endpoint of another
+// server, and decodes the response into target.
+func sendToPeer(method, address string, body []byte, target interface{}) (err error) {
+	req, err := http.NewRequest(method, address, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	err = signPeerRequest(req, getReplication().Secret, body)
+	if err != nil {
+		return
+	}
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return unreachableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, address, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// postToPeer posts a request to a replication endpoint of another server.
+func postToPeer(address string, sr serverRequest) (target serverResponse, err error) {
+	body, err := json.Marshal(sr)
+	if err != nil {
+		return
+	}
+	err = sendToPeer("POST", address, body, &target)
+	if err == nil && !target.Success {
+		err = errors.New(target.Message)
+	}
+	return
+}
+
+// catchUp applies the revisions of the primary server that were missed. A
+// file that can not be caught up on is skipped until the next time.
+func catchUp(primary string) (err error) {
+	var files []replicaFile
+	err = sendToPeer("GET", primary+"/replica/files", nil, &files)
+	if err != nil {
+		return
+	}
+	folder := getServerDataDir()
+	caughtUp, failed := 0, 0
+	for _, f := range files {
+		if validateNames(f.Username, f.Filename) != nil {
+			continue
+		}
+		pathToFile := path.Join(folder, f.Username, f.Filename)
+		var latest int64
+		revisions, _ := listRevisions(pathToFile)
+		if len(revisions) > 0 {
+			latest = revisions[len(revisions)-1]
+		}
+		hash, _ := Filemd5Sum(pathToFile)
+		var applied int
+		var errFile error
+		switch {
+		case latest < f.Revision:
+			applied, errFile = catchUpFile(primary, f.Username, f.Filename, latest)
+		case hash != f.Hash:
+			applied, errFile = resyncFile(primary, f.Username, f.Filename)
+		default:
+			continue
+		}
+		if errFile != nil {
+			log.Warnf("could not catch up on '%s' of '%s': %s", f.Filename, f.Username, errFile)
+			failed++
+			continue
+		}
+		log.Infof("caught up on %d revisions of '%s' of '%s'", applied, f.Filename, f.Username)
+		caughtUp++
+	}
+	log.Debugf("caught up on %d files with %s, %d failed", caughtUp, primary, failed)
+	return
+}
+
+// catchUpFile applies the revisions of a file after a revision from the
+// primary server, or copies the file if it is out of sync.
+func catchUpFile(primary, username, filename string, after int64) (applied int, err error) {
+	target, err := postToPeer(primary+"/replica/log", serverRequest{
+		Username: username,
+		Filename: filename,
+		Revision: after,
+	})
+	if err != nil {
+		return
+	}
+	applied, err = applyReplicaRevisions(getServerDataDir(), username, filename, target.Replica)
+	if _, ok := err.(outOfSyncError); ok {
+		log.Infof("%s, copying it again", err)
+		return resyncFile(primary, username, filename)
+	}
+	return
+}
+
+// resyncFile replaces a file with the latest revision of it on the primary
+// server.
+func resyncFile(primary, username, filename string) (applied int, err error) {
+	target, err := postToPeer(primary+"/replica/log", serverRequest{
+		Username: username,
+		Filename: filename,
+		Full:     true,
+	})
+	if err != nil {
+		return
+	}
+	return applyReplicaRevisions(getServerDataDir(), username, filename, target.Replica)
+}
+
+// replicationHandler lets only the servers with the replication secret use
+// the replication endpoints: the primary server forwards revisions to its
+// secondary servers, which get the revisions they missed from it.
+func replicationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := getReplication()
+		serves := len(config.Replicas) > 0
+		if c.FullPath() == "/replicate" {
+			serves = config.Primary != ""
+		}
+		if !serves || config.Secret == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		err := verifySignature(c, replicationSigner, config.Secret)
+		if err != nil {
+			log.Warnf("%s replication: %s", c.Request.RemoteAddr, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, serverResponse{Message: err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// addReplicationRoutes adds the replication endpoints to the router of a
+// server that replicates.
+func addReplicationRoutes(r *gin.Engine) {
+	replica := r.Group("", replicationHandler())
+	replica.POST("/replicate", handlerReplicate)       // applies revisions forwarded by the primary server
+	replica.POST("/replica/log", handlerReplicaLog)    // returns the revisions of a file after a revision
+	replica.GET("/replica/files", handlerReplicaFiles) // returns the latest revision of every file
+}
+
+func handlerReplicate(c *gin.Context) {
+	message, err := func(c *gin.Context) (message string, err error) {
+		var sr serverRequest
+		err = decodeRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s replicate: %s", sr.Username, sr.Filename, humanize.Bytes(uint64(c.Request.ContentLength)))
+		applied, err := applyReplicaRevisions(dataDir(c), sr.Username, sr.Filename, sr.Replica)
+		if err != nil {
+			// get the missed revisions from the primary server
+			if primary := getReplication().Primary; primary != "" {
+				folder := dataDir(c)
+				go func() {
+					pathToFile := path.Join(folder, sr.Username, sr.Filename)
+					var latest int64
+					revisions, _ := listRevisions(pathToFile)
+					if len(revisions) > 0 {
+						latest = revisions[len(revisions)-1]
+					}
+					if _, errCatchUp := catchUpFile(primary, sr.Username, sr.Filename, latest); errCatchUp != nil {
+						log.Warnf("could not catch up on '%s' of '%s': %s", sr.Filename, sr.Username, errCatchUp)
+					}
+				}()
+			}
+			return
+		}
+		message = fmt.Sprintf("replicated %d revisions", applied)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+func handlerReplicaLog(c *gin.Context) {
+	replicas, message, err := func(c *gin.Context) (replicas []replicaRevision, message string, err error) {
+		var sr serverRequest
+		err = decodeRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		if sr.Full {
+			replicas, err = getReplicaSnapshot(pathToFile)
+		} else {
+			replicas, err = getReplicaRevisions(pathToFile, sr.Revision)
+		}
+		message = fmt.Sprintf("%d revisions", len(replicas))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+		Replica: replicas,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+func handlerReplicaFiles(c *gin.Context) {
+	files, err := listReplicaFiles(dataDir(c))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
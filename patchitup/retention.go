@@ -0,0 +1,127 @@
+package patchitup
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// defaultRetentionInterval is how often revisions are pruned, unless
+// configured
+const defaultRetentionInterval = 24 * time.Hour
+
+// retentionConfiguration determines which revisions the server keeps. The
+// revisions older than MaxAge are pruned, except for the latest Keep and the
+// tagged ones, as with Prune.
+type retentionConfiguration struct {
+	// Keep is the number of latest revisions of each file that are kept
+	Keep int `toml:",omitempty"`
+	// MaxAge is how long revisions are kept, e.g. "720h", or zero to only
+	// keep the latest Keep revisions
+	MaxAge time.Duration `toml:",omitempty"`
+	// Interval is how often revisions are pruned (daily by default)
+	Interval time.Duration `toml:",omitempty"`
+}
+
+func (config retentionConfiguration) enabled() bool {
+	return config.Keep > 0 || config.MaxAge > 0
+}
+
+var (
+	retention = struct {
+		sync.RWMutex
+		config retentionConfiguration
+	}{}
+	startRetentionOnce sync.Once
+)
+
+func setRetention(config retentionConfiguration) {
+	retention.Lock()
+	retention.config = config
+	retention.Unlock()
+	if config.enabled() {
+		log.Infof("keeping the latest %d revisions and the revisions of the last %s", config.Keep, config.MaxAge)
+	}
+}
+
+func getRetention() retentionConfiguration {
+	retention.RLock()
+	defer retention.RUnlock()
+	return retention.config
+}
+
+// startRetention prunes the revisions of every file that are past the
+// retention, now and then.
+func startRetention() {
+	startRetentionOnce.Do(func() {
+		go func() {
+			for {
+				config := getRetention()
+				if config.enabled() {
+					pruned, err := applyRetention(config)
+					if err != nil {
+						log.Warnf("problem pruning revisions: %s", err)
+					} else if pruned > 0 {
+						log.Infof("pruned %d revisions past the retention", pruned)
+					}
+				}
+				interval := config.Interval
+				if interval <= 0 {
+					interval = defaultRetentionInterval
+				}
+				time.Sleep(interval)
+			}
+		}()
+	})
+}
+
+// applyRetention prunes the revisions of the files of every user.
+func applyRetention(config retentionConfiguration) (pruned int, err error) {
+	var before int64
+	if config.MaxAge > 0 {
+		before = time.Now().Add(-config.MaxAge).UnixNano() / int64(time.Millisecond)
+	}
+	folder := getServerDataDir()
+	users, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		if !user.IsDir() || strings.HasPrefix(user.Name(), ".") {
+			continue
+		}
+		entries, errRead := ioutil.ReadDir(path.Join(folder, user.Name()))
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		for _, entry := range entries {
+			if _, ok := isTrackedFile(path.Join(folder, user.Name()), entry); !ok {
+				continue
+			}
+			var n int
+			n, err = pruneFile(folder, user.Name(), entry.Name(), before, config.Keep)
+			if err != nil {
+				return
+			}
+			pruned += n
+		}
+	}
+	return
+}
+
+// pruneFile prunes the revisions of a file of a user in the data folder.
+func pruneFile(folder, username, filename string, before int64, keep int) (pruned int, err error) {
+	pathToFile := path.Join(folder, username, filename)
+	unlock := lockUser(username)
+	defer unlock()
+	protected, err := protectedRevisions(folder, username, filename, pathToFile)
+	if err != nil {
+		return
+	}
+	return pruneRevisions(pathToFile, before, keep, protected)
+}
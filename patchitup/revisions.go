@@ -0,0 +1,156 @@
+package patchitup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Every patch applied to a file on the server is kept next to it as
+// <file>.<unix millis>, so the state of the file at any revision can be
+// rebuilt by applying the patches in order to an empty file.
+
+// listRevisions returns the revisions of a file in increasing order.
+func listRevisions(pathToFile string) (revisions []int64, err error) {
+	folder, filename := filepath.Split(pathToFile)
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), filename+".") {
+			continue
+		}
+		revision, errParse := strconv.ParseInt(strings.TrimPrefix(f.Name(), filename+"."), 10, 64)
+		if errParse != nil {
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	return
+}
+
+// isTrackedFile returns whether an entry of the folder of a user is a file
+// with revisions, along with them. Revisions are files too, but have no
+// revisions of their own.
+func isTrackedFile(folder string, entry os.FileInfo) (revisions []int64, ok bool) {
+	if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+		return
+	}
+	revisions, _ = listRevisions(filepath.Join(folder, entry.Name()))
+	ok = len(revisions) > 0
+	return
+}
+
+// pathToRevision returns the path of the patch stored for a revision.
+func pathToRevision(pathToFile string, revision int64) string {
+	return fmt.Sprintf("%s.%d", pathToFile, revision)
+}
+
+// getRevisionText rebuilds the file as it was after the given revision by
+// applying every patch up to and including it.
+func getRevisionText(pathToFile string, revision int64) (text string, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	for _, r := range revisions {
+		if r > revision {
+			break
+		}
+		compressedPatch, errRead := ioutil.ReadFile(pathToRevision(pathToFile, r))
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		patch, d, errPatch := readPatch(string(compressedPatch))
+		if errPatch != nil {
+			err = errors.Wrapf(errPatch, "problem reading revision %d", r)
+			return
+		}
+		text, err = d.Apply(text, patch)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// getTextAt returns the text of a file at the specified revision, which is
+// either a revision number, a tag or "current" (or empty) for the current
+// copy.
+func getTextAt(pathToFile, revision string) (text string, err error) {
+	if revision == "" || revision == "current" {
+		return getFileText(pathToFile)
+	}
+	if tag, ok := getTag(pathToFile, revision); ok {
+		return getRevisionText(pathToFile, tag.Revision)
+	}
+	r, err := strconv.ParseInt(revision, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("'%s' is not a revision", revision)
+		return
+	}
+	if !Exists(pathToRevision(pathToFile, r)) {
+		err = fmt.Errorf("revision %d not found", r)
+		return
+	}
+	return getRevisionText(pathToFile, r)
+}
+
+// timeFormats are the accepted formats for restoring by time
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseRevisionTime parses a time, either in one of the timeFormats (UTC
+// unless a zone is given) or as unix milliseconds, into unix milliseconds.
+func parseRevisionTime(s string) (millis int64, err error) {
+	millis, err = strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return
+	}
+	for _, format := range timeFormats {
+		t, errParse := time.Parse(format, s)
+		if errParse == nil {
+			millis = t.UnixNano() / int64(time.Millisecond)
+			err = nil
+			return
+		}
+	}
+	err = fmt.Errorf("could not parse time '%s'", s)
+	return
+}
+
+// getRevisionAt returns the latest revision at or before the time (in unix
+// milliseconds).
+func getRevisionAt(pathToFile string, millis int64) (revision int64, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	for _, r := range revisions {
+		if r > millis {
+			break
+		}
+		revision = r
+	}
+	if revision == 0 {
+		err = fmt.Errorf("no revision at or before %s", time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+	}
+	return
+}
@@ -1,11 +1,13 @@
 package patchitup
 
 import (
-	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -14,41 +16,154 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Run will run the main program
+// defaultListen is the address that the server listens on, unless
+// configured
+const defaultListen = ":8002"
+
+// Run will run the main program. The port, if given, overrides the address
+// in the server configuration.
 func Run(port string) (err error) {
-	os.MkdirAll(path.Join(UserHomeDir(), ".patchitup", "server"), 0755)
+	config, err := loadServerConfiguration()
+	if err != nil {
+		return
+	}
+	if port != "" {
+		config.Listen = ":" + port
+	} else if config.Listen == "" {
+		config.Listen = defaultListen
+	}
+	// the events of the files are matched by their clean data folder
+	config.DataDir = path.Clean(config.DataDir)
+	setServerDataDir(config.DataDir)
+	os.MkdirAll(config.DataDir, 0755)
+	cleanUploadSessions(config.DataDir)
+	err = applyServerConfiguration(config)
+	if err != nil {
+		return
+	}
+	startWebhooks()
+	startReplication()
+	startRetention()
+	reloadOnHangup(config)
 
 	defer log.Flush()
+	r := newRouter(config.DataDir)
+	if getReplication().enabled() {
+		addReplicationRoutes(r)
+	}
+	host, port, _ := net.SplitHostPort(config.Listen)
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if serverTLS || (config.TLS != nil && config.TLS.Enabled) {
+		log.Infof("Running at https://%s:%s", host, port)
+		err = runTLS(r, config.Listen, config.TLS)
+		return
+	}
+	log.Infof("Running at http://%s:%s", host, port)
+	err = r.Run(config.Listen)
+	return
+}
+
+// serverDataDir is the data folder of the running server, where its
+// configuration is kept
+var serverDataDir = struct {
+	sync.RWMutex
+	folder string
+}{}
+
+// setServerDataDir sets the data folder of the running server, before it
+// starts.
+func setServerDataDir(folder string) {
+	serverDataDir.Lock()
+	serverDataDir.folder = folder
+	serverDataDir.Unlock()
+}
+
+// getServerDataDir returns the data folder of the running server, or the
+// default data folder if no server is running.
+func getServerDataDir() string {
+	serverDataDir.RLock()
+	defer serverDataDir.RUnlock()
+	if serverDataDir.folder == "" {
+		return pathToCacheServer
+	}
+	return serverDataDir.folder
+}
+
+// dataDirKey is the key of the data folder of the router in the context of
+// a request
+const dataDirKey = "dataDir"
+
+// dataDir returns the data folder of the router that handles the request.
+func dataDir(c *gin.Context) string {
+	return c.GetString(dataDirKey)
+}
+
+// newRouter returns the router of a server that keeps the files in the data
+// folder.
+func newRouter(folder string) *gin.Engine {
+	addDictionaryFolder(folder)
 	// setup gin server
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(middleWareHandler(), gin.Recovery())
+	r.Use(func(c *gin.Context) { c.Set(dataDirKey, folder) }, middleWareHandler(), gin.Recovery(), limitHandler(), signatureHandler(), userLimitHandler())
 	r.HEAD("/", func(c *gin.Context) { // handler for the uptime robot
 		c.String(http.StatusOK, "OK")
 	})
-	r.POST("/lineNumbers", handlerLineNumbers) // returns hash and line numbers
-	r.POST("/lineText", handlerLineText)       // returns hash and line text
-	r.POST("/patch", handlerPatch)             // patch a file
-	r.POST("/fileHash", handlerFileHash)       // get the hash of a file
-	log.Infof("Running at http://0.0.0.0:" + port)
-	err = r.Run(":" + port)
-	return
+	r.GET("/capabilities", handlerCapabilities)   // what the server supports
+	r.POST("/lineNumbers", handlerLineNumbers)    // returns hash and line numbers
+	r.POST("/lineText", handlerLineText)          // returns hash and line text
+	r.POST("/patch", handlerPatch)                // patch a file
+	r.POST("/fileHash", handlerFileHash)          // get the hash of a file
+	r.POST("/revisions", handlerRevisions)        // list the revisions of a file
+	r.POST("/diff", handlerDiff)                  // diff between two revisions
+	r.POST("/restore", handlerRestore)            // get a file as it was at a time
+	r.POST("/upload/start", handlerUploadStart)   // start or resume a chunked upload
+	r.POST("/upload/chunk", handlerUploadChunk)   // upload one chunk
+	r.POST("/upload/commit", handlerUploadCommit) // apply a completed chunked upload
+	r.POST("/reconstruct", handlerReconstruct)    // returns the lines missing from a filter
+	r.POST("/dictionary", handlerDictionary)      // returns the compression dictionary of a file
+	r.POST("/commit", handlerCommit)              // applies patches to several files at once
+	r.POST("/commits", handlerCommits)            // returns the commits of a user
+	r.POST("/tag", handlerTag)                    // tags a revision of a file
+	r.POST("/tags", handlerTags)                  // returns the tags of a file
+	r.POST("/prune", handlerPrune)                // squashes old revisions of a file
+	r.POST("/delete", handlerDelete)              // deletes a file and its revisions
+	r.GET("/events", handlerEvents)               // stream of changes to the files of a user
+	r.POST("/webhooks/test", handlerWebhookTest)  // sends a test event to the webhooks of a user
+	r.POST("/webhooks/log", handlerWebhookLog)    // returns the webhook deliveries of a user
+	r.POST("/bundle", handlerBundle)              // imports a bundle of patches made offline
+
+	// the read-only web UI
+	ui := r.Group("/ui", uiAuthHandler())
+	ui.GET("/", handlerUIUsers)
+	ui.GET("/:username/", handlerUIFiles)
+	ui.GET("/:username/:filename", handlerUIFile)
+	ui.GET("/:username/:filename/diff", handlerUIDiff)
+	ui.GET("/:username/:filename/download", handlerUIDownload)
+	return r
 }
 
 func handlerFileHash(c *gin.Context) {
 	message, err := func(c *gin.Context) (message string, err error) {
 		var sr serverRequest
-		err = c.ShouldBindJSON(&sr)
+		err = bindRequest(c, &sr)
 		if err != nil {
 			return
 		}
 		log.Infof("%s/%s upload: %s", sr.Username, sr.Filename, humanize.Bytes(uint64(c.Request.ContentLength)))
 
+		err = validateNames(sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
 		// create cache directory
-		if !Exists(path.Join(pathToCacheServer, sr.Username)) {
-			os.MkdirAll(path.Join(pathToCacheServer, sr.Username), 0755)
+		if !Exists(path.Join(dataDir(c), sr.Username)) {
+			os.MkdirAll(path.Join(dataDir(c), sr.Username), 0755)
 		}
-		pathToFile := path.Join(pathToCacheServer, sr.Username, sr.Filename)
+		pathToFile := path.Join(dataDir(c), sr.Username, sr.Filename)
 		if !Exists(pathToFile) {
 			message = "created new file"
 			newFile, err2 := os.Create(pathToFile)
@@ -71,15 +186,13 @@ func handlerFileHash(c *gin.Context) {
 		Message: message,
 		Success: err == nil,
 	}
-	bSR, _ := json.Marshal(sr)
-	log.Infof("download: %s", humanize.Bytes(uint64(len(bSR))))
-	c.JSON(http.StatusOK, sr)
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
 }
 
 func handlerPatch(c *gin.Context) {
 	message, err := func(c *gin.Context) (message string, err error) {
 		var sr serverRequest
-		err = c.ShouldBindJSON(&sr)
+		err = bindRequest(c, &sr)
 		if err != nil {
 			return
 		}
@@ -89,11 +202,24 @@ func handlerPatch(c *gin.Context) {
 		}
 		log.Infof("%s/%s upload: %s", sr.Username, sr.Filename, humanize.Bytes(uint64(c.Request.ContentLength)))
 
+		err = validateNames(sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
+		// the tag is checked before the patch is applied
+		if sr.Tag != "" {
+			err = validateTagName(sr.Tag)
+			if err != nil {
+				return
+			}
+		}
+
 		// create cache directory
-		if !Exists(path.Join(pathToCacheServer, sr.Username)) {
-			os.MkdirAll(path.Join(pathToCacheServer, sr.Username), 0755)
+		if !Exists(path.Join(dataDir(c), sr.Username)) {
+			os.MkdirAll(path.Join(dataDir(c), sr.Username), 0755)
 		}
-		pathToFile := path.Join(pathToCacheServer, sr.Username, sr.Filename)
+		pathToFile := path.Join(dataDir(c), sr.Username, sr.Filename)
 		if !Exists(pathToFile) {
 			message = "created new file"
 			newFile, err2 := os.Create(pathToFile)
@@ -105,10 +231,18 @@ func handlerPatch(c *gin.Context) {
 			return
 		}
 
-		err = patchFile(pathToFile, sr.Patch)
-		if err == nil {
-			message = "applied patch"
+		unlock := lockUser(sr.Username)
+		defer unlock()
+		baseHash := textHash(pathToFile)
+		err = patchFile(pathToFile, string(sr.Patch))
+		if err != nil {
+			return
 		}
+		message = "applied patch"
+		if sr.Tag != "" {
+			_, err = tagLatestRevision(pathToFile, sr.Tag, sr.Message)
+		}
+		publishPatch(sr.Username, sr.Filename, pathToFile, baseHash, len(sr.Patch))
 		return
 	}(c)
 	if err != nil {
@@ -119,26 +253,29 @@ func handlerPatch(c *gin.Context) {
 		Message: message,
 		Success: err == nil,
 	}
-	bSR, _ := json.Marshal(sr)
-	log.Infof("download: %s", humanize.Bytes(uint64(len(bSR))))
-	c.JSON(http.StatusOK, sr)
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
 }
 
 func handlerLineText(c *gin.Context) {
 	lines, message, err := func(c *gin.Context) (lines map[string][]byte, message string, err error) {
 		lines = make(map[string][]byte)
 		var sr serverRequest
-		err = c.ShouldBindJSON(&sr)
+		err = bindRequest(c, &sr)
 		if err != nil {
 			return
 		}
 		log.Infof("%s/%s upload: %s", sr.Username, sr.Filename, humanize.Bytes(uint64(c.Request.ContentLength)))
 
+		err = validateNames(sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
 		// create cache directory
-		if !Exists(path.Join(pathToCacheServer, sr.Username)) {
-			os.MkdirAll(path.Join(pathToCacheServer, sr.Username), 0755)
+		if !Exists(path.Join(dataDir(c), sr.Username)) {
+			os.MkdirAll(path.Join(dataDir(c), sr.Username), 0755)
 		}
-		pathToFile := path.Join(pathToCacheServer, sr.Username, sr.Filename)
+		pathToFile := path.Join(dataDir(c), sr.Username, sr.Filename)
 		if !Exists(pathToFile) {
 			message = "created new file"
 			newFile, err2 := os.Create(pathToFile)
@@ -174,25 +311,28 @@ func handlerLineText(c *gin.Context) {
 		Success:      err == nil,
 		HashLineText: lines,
 	}
-	bSR, _ := json.Marshal(sr)
-	log.Infof("download: %s", humanize.Bytes(uint64(len(bSR))))
-	c.JSON(http.StatusOK, sr)
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
 }
 func handlerLineNumbers(c *gin.Context) {
 	lines, message, err := func(c *gin.Context) (lines map[string][]int, message string, err error) {
 		lines = make(map[string][]int)
 		var sr serverRequest
-		err = c.ShouldBindJSON(&sr)
+		err = bindRequest(c, &sr)
 		if err != nil {
 			return
 		}
 		log.Infof("%s/%s upload: %d", sr.Username, sr.Filename, c.Request.ContentLength)
 
+		err = validateNames(sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
 		// create cache directory
-		if !Exists(path.Join(pathToCacheServer, sr.Username)) {
-			os.MkdirAll(path.Join(pathToCacheServer, sr.Username), 0755)
+		if !Exists(path.Join(dataDir(c), sr.Username)) {
+			os.MkdirAll(path.Join(dataDir(c), sr.Username), 0755)
 		}
-		pathToFile := path.Join(pathToCacheServer, sr.Username, sr.Filename)
+		pathToFile := path.Join(dataDir(c), sr.Username, sr.Filename)
 		if !Exists(pathToFile) {
 			message = "created new file"
 			newFile, err2 := os.Create(pathToFile)
@@ -220,9 +360,159 @@ func handlerLineNumbers(c *gin.Context) {
 		Success:         err == nil,
 		HashLinenumbers: lines,
 	}
-	bSR, _ := json.Marshal(sr)
-	log.Infof("download: %s", humanize.Bytes(uint64(len(bSR))))
-	c.JSON(http.StatusOK, sr)
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// validateNames makes sure that user and file names can not escape the
+// server directory or collide with its hidden folders.
+func validateNames(names ...string) (err error) {
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+			err = fmt.Errorf("invalid name '%s'", name)
+			return
+		}
+	}
+	return
+}
+
+// pathToServerFile returns the path of an existing file in the data folder.
+func pathToServerFile(folder, username, filename string) (pathToFile string, err error) {
+	err = validateNames(username, filename)
+	if err != nil {
+		return
+	}
+	pathToFile = path.Join(folder, username, filename)
+	if !Exists(pathToFile) {
+		err = fmt.Errorf("'%s' not found for '%s'", filename, username)
+	}
+	return
+}
+
+func handlerRevisions(c *gin.Context) {
+	revisions, message, err := func(c *gin.Context) (revisions []int64, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		revisions, err = listRevisions(pathToFile)
+		message = fmt.Sprintf("found %d revisions", len(revisions))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sendResponse(c, serverResponse{
+		Message:   message,
+		Success:   err == nil,
+		Revisions: revisions,
+	})
+}
+
+func handlerDiff(c *gin.Context) {
+	diff, hunks, message, err := func(c *gin.Context) (diff string, hunks []diffHunk, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s diff %s..%s", sr.Username, sr.Filename, sr.From, sr.To)
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		fromText, err := getTextAt(pathToFile, sr.From)
+		if err != nil {
+			return
+		}
+		toText, err := getTextAt(pathToFile, sr.To)
+		if err != nil {
+			return
+		}
+		diff, hunks = unifiedDiff(revisionName(sr.Filename, sr.From), revisionName(sr.Filename, sr.To), fromText, toText)
+		message = fmt.Sprintf("%d hunks", len(hunks))
+		if sr.Format == "json" {
+			diff = ""
+		} else {
+			hunks = nil
+		}
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+		Data:    base64String(diff),
+		Hunks:   hunks,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+func handlerRestore(c *gin.Context) {
+	data, revision, message, err := func(c *gin.Context) (data string, revision int64, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s restore at '%s'", sr.Username, sr.Filename, sr.At)
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+
+		var text string
+		if sr.At == "" {
+			text, err = getFileText(pathToFile)
+		} else {
+			revision, err = resolveRevision(pathToFile, sr.At)
+			if err != nil {
+				return
+			}
+			text, err = getRevisionText(pathToFile, revision)
+		}
+		if err != nil {
+			return
+		}
+		// the text is compressed the same way as patches
+		data = compressPatch(text)
+		message = fmt.Sprintf("restored revision %d", revision)
+		// getting the current copy is not a restore
+		if sr.At != "" {
+			events.publish(Event{
+				Type:     EventRestore,
+				Username: sr.Username,
+				Filename: sr.Filename,
+				Revision: revision,
+				dataDir:  dataDir(c),
+			})
+		}
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:  message,
+		Success:  err == nil,
+		Data:     base64String(data),
+		Revision: revision,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// revisionName is the name of a revision of a file used in diff headers
+func revisionName(filename, revision string) string {
+	if revision == "" {
+		revision = "current"
+	}
+	return filename + "@" + revision
 }
 
 func middleWareHandler() gin.HandlerFunc {
@@ -232,6 +522,16 @@ func middleWareHandler() gin.HandlerFunc {
 		addCORS(c)
 		// Run next function
 		c.Next()
+		// count the bandwidth of the users with files. The user that a request
+		// is made for is only taken at their word on a server without secrets,
+		// as a server with client certificates knows the user of every request.
+		username := authenticatedUser(c)
+		if username == "" && !hasSecrets() {
+			username = c.GetString(requestUserKey)
+		}
+		if validateNames(username) == nil && Exists(path.Join(dataDir(c), username)) {
+			addBandwidthOf(username, c.Request.ContentLength, int64(c.Writer.Size()))
+		}
 		// Log request
 		log.Infof("%v %v %v %s", c.Request.RemoteAddr, c.Request.Method, c.Request.URL, time.Since(t))
 	}
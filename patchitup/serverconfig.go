@@ -0,0 +1,319 @@
+package patchitup
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// The server is configured with a TOML file given with
+// SetServerConfiguration (or $PATCHITUP_CONFIG), like
+//
+//   Listen = ":8002"
+//   DataDir = "/var/lib/patchitup"
+//   LogLevel = "info"
+//
+//   [TLS]
+//   Enabled = true
+//
+//   [Secrets]
+//   me = "a long random string"
+//
+//   [Limits]
+//   MaxFileSize = 104857600
+//
+//   [Retention]
+//   MaxAge = "2160h"
+//
+//   [UI.Admins]
+//   admin = "a long password"
+//
+// and each setting can be overridden with an environment variable (see
+// serverEnvironment). The TLS, Secrets and Limits that are not in the
+// configuration are read from their files in the data folder as before. On
+// SIGHUP the configuration is read again and everything except Listen,
+// DataDir and TLS is applied.
+
+// serverConfiguration is the configuration of the server
+type serverConfiguration struct {
+	// Listen is the address that the server listens on, e.g. ":8002"
+	Listen string
+	// DataDir is the folder of the files of the users
+	DataDir string
+	// LogLevel is the level of the logs (trace, debug, info, warn, error or critical)
+	LogLevel  string
+	TLS       *tlsConfiguration
+	Secrets   map[string]string
+	Limits    *limitsConfiguration
+	Retention retentionConfiguration
+	UI        uiConfiguration
+}
+
+// pathToServerConfig is the configuration file of the server, if any
+var pathToServerConfig string
+
+// SetServerConfiguration determines the configuration file of the server.
+func SetServerConfiguration(pathToConfig string) {
+	pathToServerConfig = pathToConfig
+}
+
+// serverEnvironment are the environment variables that override the
+// configuration of the server
+var serverEnvironment = map[string]func(config *serverConfiguration, value string) error{
+	"PATCHITUP_LISTEN": func(config *serverConfiguration, value string) error {
+		config.Listen = value
+		return nil
+	},
+	"PATCHITUP_DATA_DIR": func(config *serverConfiguration, value string) error {
+		config.DataDir = value
+		return nil
+	},
+	"PATCHITUP_LOG_LEVEL": func(config *serverConfiguration, value string) error {
+		config.LogLevel = value
+		return nil
+	},
+	"PATCHITUP_TLS": func(config *serverConfiguration, value string) (err error) {
+		config.tls().Enabled, err = strconv.ParseBool(value)
+		return
+	},
+	"PATCHITUP_TLS_CERT": func(config *serverConfiguration, value string) error {
+		config.tls().Cert = value
+		return nil
+	},
+	"PATCHITUP_TLS_KEY": func(config *serverConfiguration, value string) error {
+		config.tls().Key = value
+		return nil
+	},
+	"PATCHITUP_TLS_CLIENT_CA": func(config *serverConfiguration, value string) error {
+		config.tls().ClientCA = value
+		return nil
+	},
+	"PATCHITUP_MAX_BODY_SIZE": func(config *serverConfiguration, value string) (err error) {
+		config.limits().MaxBodySize, err = strconv.ParseInt(value, 10, 64)
+		return
+	},
+	"PATCHITUP_MAX_FILE_SIZE": func(config *serverConfiguration, value string) (err error) {
+		config.limits().MaxFileSize, err = strconv.ParseInt(value, 10, 64)
+		return
+	},
+	"PATCHITUP_USER_RATE": func(config *serverConfiguration, value string) (err error) {
+		config.limits().UserRate, err = strconv.ParseFloat(value, 64)
+		return
+	},
+	"PATCHITUP_IP_RATE": func(config *serverConfiguration, value string) (err error) {
+		config.limits().IPRate, err = strconv.ParseFloat(value, 64)
+		return
+	},
+	"PATCHITUP_RETENTION_KEEP": func(config *serverConfiguration, value string) (err error) {
+		config.Retention.Keep, err = strconv.Atoi(value)
+		return
+	},
+	"PATCHITUP_RETENTION_MAX_AGE": func(config *serverConfiguration, value string) (err error) {
+		config.Retention.MaxAge, err = time.ParseDuration(value)
+		return
+	},
+	// an admin of the web UI, as name:password
+	"PATCHITUP_UI_ADMIN": func(config *serverConfiguration, value string) error {
+		i := strings.Index(value, ":")
+		if i < 1 {
+			return errors.New("must be name:password")
+		}
+		if config.UI.Admins == nil {
+			config.UI.Admins = make(map[string]string)
+		}
+		config.UI.Admins[value[:i]] = value[i+1:]
+		return nil
+	},
+}
+
+// tls returns the TLS configuration, which is added if there is none.
+func (config *serverConfiguration) tls() *tlsConfiguration {
+	if config.TLS == nil {
+		config.TLS = &tlsConfiguration{}
+	}
+	return config.TLS
+}
+
+// limits returns the limits, which are added with the defaults if there
+// are none.
+func (config *serverConfiguration) limits() *limitsConfiguration {
+	if config.Limits == nil {
+		config.Limits = &limitsConfiguration{MaxBodySize: defaultMaxBodySize}
+	}
+	return config.Limits
+}
+
+// loadServerConfiguration reads the configuration of the server and the
+// environment, and validates it.
+func loadServerConfiguration() (config serverConfiguration, err error) {
+	config.DataDir = pathToCacheServer
+	pathToConfig := pathToServerConfig
+	if pathToConfig == "" {
+		pathToConfig = os.Getenv("PATCHITUP_CONFIG")
+	}
+	if pathToConfig != "" {
+		var meta toml.MetaData
+		meta, err = toml.DecodeFile(pathToConfig, &config)
+		if err != nil {
+			return
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			err = fmt.Errorf("unknown setting '%s' in %s", undecoded[0], pathToConfig)
+			return
+		}
+		// limits that are not set are the defaults
+		if config.Limits != nil && !meta.IsDefined("Limits", "MaxBodySize") {
+			config.Limits.MaxBodySize = defaultMaxBodySize
+		}
+	}
+	for name, override := range serverEnvironment {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err = override(&config, value)
+		if err != nil {
+			err = errors.Wrap(err, name)
+			return
+		}
+	}
+	err = config.validate()
+	if err != nil && pathToConfig != "" {
+		err = errors.Wrap(err, pathToConfig)
+	}
+	return
+}
+
+func (config serverConfiguration) validate() (err error) {
+	if config.Listen != "" {
+		_, _, err = net.SplitHostPort(config.Listen)
+		if err != nil {
+			return errors.Wrap(err, "bad Listen address")
+		}
+	}
+	if config.DataDir == "" {
+		return errors.New("DataDir can not be empty")
+	}
+	switch config.LogLevel {
+	case "", "trace", "debug", "info", "warn", "error", "critical":
+	default:
+		return fmt.Errorf("unknown LogLevel '%s'", config.LogLevel)
+	}
+	if config.TLS != nil {
+		err = config.TLS.validate()
+		if err != nil {
+			return
+		}
+	}
+	err = validateSecrets(config.Secrets)
+	if err != nil {
+		return
+	}
+	if config.Limits != nil {
+		err = config.Limits.validate()
+		if err != nil {
+			return
+		}
+	}
+	if config.Retention.Keep < 0 || config.Retention.MaxAge < 0 || config.Retention.Interval < 0 {
+		return errors.New("retention can not be negative")
+	}
+	for name, password := range config.UI.Admins {
+		if password == "" {
+			return fmt.Errorf("empty password for the admin '%s'", name)
+		}
+	}
+	for username, password := range config.UI.Users {
+		if password == "" {
+			return fmt.Errorf("empty password for the user '%s'", username)
+		}
+	}
+	return
+}
+
+// applyServerConfiguration applies the settings that can change while the
+// server is running, and reads the configuration files in the data folder.
+// Every part is read before any is applied, so that a configuration that is
+// not valid leaves the settings as they were.
+func applyServerConfiguration(config serverConfiguration) (err error) {
+	list, err := readWebhooks()
+	if err != nil {
+		return
+	}
+	replicationConfig, err := readReplication()
+	if err != nil {
+		return
+	}
+	users, err := readSecrets(config.Secrets)
+	if err != nil {
+		return
+	}
+	limits, err := readLimits(config.Limits)
+	if err != nil {
+		return
+	}
+	if config.LogLevel != "" {
+		err = SetLogLevel(config.LogLevel)
+		if err != nil {
+			return
+		}
+	}
+	setWebhooks(list)
+	setReplication(replicationConfig)
+	setSecrets(users)
+	setLimits(limits)
+	setRetention(config.Retention)
+	setUI(config.UI)
+	return
+}
+
+var reloadOnce sync.Once
+
+// reloadOnHangup reloads the configuration of the server on SIGHUP. A
+// configuration that is not valid is not applied.
+func reloadOnHangup(running serverConfiguration) {
+	reloadOnce.Do(func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		go func() {
+			for range hangup {
+				log.Info("reloading the configuration")
+				err := reloadServerConfiguration(running)
+				if err != nil {
+					log.Errorf("configuration not reloaded: %s", err)
+				}
+			}
+		}()
+	})
+}
+
+// reloadServerConfiguration applies the current configuration to the
+// running server, except for the settings of the listener.
+func reloadServerConfiguration(running serverConfiguration) (err error) {
+	config, err := loadServerConfiguration()
+	if err != nil {
+		return
+	}
+	if config.DataDir != running.DataDir {
+		log.Warnf("restart the server to use the data folder '%s'", config.DataDir)
+	}
+	if config.Listen != running.Listen && config.Listen != "" {
+		log.Warnf("restart the server to listen on '%s'", config.Listen)
+	}
+	replicating := getReplication().enabled()
+	err = applyServerConfiguration(config)
+	if err == nil && !replicating && getReplication().enabled() {
+		log.Warn("restart the server to serve the replication endpoints")
+	}
+	return
+}
@@ -0,0 +1,277 @@
+package patchitup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Requests can be signed with a secret of the user instead of using TLS,
+// e.g. for devices behind a proxy that is trusted. The server keeps the
+// secrets of the users in .secrets.toml in the server folder, like
+//
+//   [Secrets]
+//   me = "a long random string"
+//
+// and the client keeps its secret as Secret in config.toml. Each request
+// carries the user, a timestamp, a random nonce and an HMAC of them and the
+// body. The server rejects requests of users with a secret that are not
+// signed, are older than signatureWindow, were seen before or do not match.
+
+// headers of signed requests
+const (
+	headerUser      = "X-Patchitup-User"
+	headerTimestamp = "X-Patchitup-Timestamp"
+	headerNonce     = "X-Patchitup-Nonce"
+	headerSignature = "X-Patchitup-Signature"
+)
+
+// signatureWindow is how far the timestamp of a signed request can be from
+// the time of the server
+const signatureWindow = 5 * time.Minute
+
+// signedUserKey is the key of the user of a verified signature in the
+// context of a request
+const signedUserKey = "signedUser"
+
+// secrets are the secrets of the users that sign their requests
+var secrets = struct {
+	sync.RWMutex
+	users map[string]string
+}{}
+
+// nonces are the nonces of the signed requests within the signature
+// window, which are not accepted again
+var nonces = struct {
+	sync.Mutex
+	seen map[string]time.Time
+}{seen: make(map[string]time.Time)}
+
+func pathToSecrets() string {
+	return path.Join(getServerDataDir(), ".secrets.toml")
+}
+
+// loadSecrets loads the secrets of the users, unless they are in the
+// server configuration.
+func loadSecrets(configured map[string]string) (err error) {
+	users, err := readSecrets(configured)
+	if err != nil {
+		return
+	}
+	setSecrets(users)
+	return
+}
+
+// readSecrets reads and validates the secrets of the users, unless they are
+// in the server configuration.
+func readSecrets(configured map[string]string) (users map[string]string, err error) {
+	var config struct {
+		Secrets map[string]string
+	}
+	if configured != nil {
+		config.Secrets = configured
+	} else if Exists(pathToSecrets()) {
+		_, err = toml.DecodeFile(pathToSecrets(), &config)
+		if err != nil {
+			return
+		}
+	}
+	err = validateSecrets(config.Secrets)
+	if err != nil {
+		return
+	}
+	users = config.Secrets
+	return
+}
+
+func setSecrets(users map[string]string) {
+	secrets.Lock()
+	secrets.users = users
+	secrets.Unlock()
+	log.Infof("loaded secrets of %d users", len(users))
+}
+
+func validateSecrets(users map[string]string) error {
+	for username, secret := range users {
+		if secret == "" {
+			return fmt.Errorf("empty secret for '%s'", username)
+		}
+	}
+	return nil
+}
+
+func userSecret(username string) (secret string, ok bool) {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	secret, ok = secrets.users[username]
+	return
+}
+
+// hasSecrets returns whether any user has a secret.
+func hasSecrets() bool {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	return len(secrets.users) > 0
+}
+
+// signature returns the HMAC of a request, which covers its method and its
+// path with the query, so that it can not be sent to another endpoint.
+func signature(secret, username, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", username, method, uri, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureHandler verifies the signatures of requests of users that have a
+// secret. Requests without a signature are left to authorizeUser.
+func signatureHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetHeader(headerUser)
+		if username == "" {
+			c.Next()
+			return
+		}
+		secret, ok := userSecret(username)
+		if !ok {
+			c.Next()
+			return
+		}
+		err := verifySignature(c, username, secret)
+		if err != nil {
+			log.Warnf("%s %s: %s", c.Request.RemoteAddr, username, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, serverResponse{Message: err.Error()})
+			return
+		}
+		c.Set(signedUserKey, username)
+		c.Next()
+	}
+}
+
+// verifySignature checks the signature of a request, and keeps its body to
+// be read by the handler.
+func verifySignature(c *gin.Context, username, secret string) (err error) {
+	timestamp, nonce := c.GetHeader(headerTimestamp), c.GetHeader(headerNonce)
+	if timestamp == "" || nonce == "" {
+		return errors.New("signature incomplete")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("bad timestamp")
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > signatureWindow || age < -signatureWindow {
+		return errors.New("request is stale")
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	expected := signature(secret, username, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(c.GetHeader(headerSignature))) {
+		return errors.New("bad signature")
+	}
+
+	nonces.Lock()
+	defer nonces.Unlock()
+	for key, t := range nonces.seen {
+		if time.Since(t) > 2*signatureWindow {
+			delete(nonces.seen, key)
+		}
+	}
+	key := username + "/" + nonce
+	if _, seen := nonces.seen[key]; seen {
+		return errors.New("request was replayed")
+	}
+	nonces.seen[key] = time.Now()
+	return
+}
+
+// checkSignedUser returns an error if the user signs their requests and
+// the request was not signed by them.
+func checkSignedUser(c *gin.Context, username string) error {
+	if _, ok := userSecret(username); !ok {
+		return nil
+	}
+	if signed := c.GetString(signedUserKey); signed != username {
+		return fmt.Errorf("requests of '%s' must be signed", username)
+	}
+	return nil
+}
+
+// authorizeUser returns an error if the request can not act as the user,
+// by its client certificate or its signature.
+func authorizeUser(c *gin.Context, username string) error {
+	err := checkCertificateUser(c, username)
+	if err != nil {
+		return err
+	}
+	return checkSignedUser(c, username)
+}
+
+// clientSecret identifies the secret of a user on a server
+type clientSecret struct {
+	address, username string
+}
+
+// clientSecrets are the secrets that requests are signed with
+var clientSecrets = struct {
+	sync.Mutex
+	secrets map[clientSecret]string
+}{secrets: make(map[clientSecret]string)}
+
+// setClientSecret configures the secret of the user on the server of the
+// configuration.
+func setClientSecret(c clientConfiguration) {
+	if c.Secret == "" {
+		return
+	}
+	clientSecrets.Lock()
+	clientSecrets.secrets[clientSecret{c.ServerAddress, c.Username}] = c.Secret
+	clientSecrets.Unlock()
+}
+
+// signRequest signs a request of the user, if the user has a secret for
+// the server of the request.
+func signRequest(req *http.Request, username string, body []byte) (err error) {
+	secret, ok := "", false
+	clientSecrets.Lock()
+	for s, sSecret := range clientSecrets.secrets {
+		if s.username == username && strings.HasPrefix(req.URL.String(), s.address+"/") {
+			secret, ok = sSecret, true
+			break
+		}
+	}
+	clientSecrets.Unlock()
+	if !ok {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bNonce := make([]byte, 16)
+	_, err = rand.Read(bNonce)
+	if err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(bNonce)
+	req.Header.Set(headerUser, username)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, signature(secret, username, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return
+}
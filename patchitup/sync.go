@@ -0,0 +1,274 @@
+package patchitup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// A sync goes both ways: the cached remote copy is the state of the file at
+// the last sync, so changes on the server since then are detected by its
+// hash. Those changes are merged into the local file with a three-way merge
+// (with the cached remote copy as the base) before the result is patched up.
+// Overlapping changes are conflicts, which are marked in the local file like
+//
+//   <<<<<<< local
+//   the local lines
+//   =======
+//   the remote lines
+//   >>>>>>> remote
+//
+// and not uploaded until they are resolved and the file is synced again.
+
+// mergeChunk is a change to the base lines [start, end) that replaces them
+// with lines
+type mergeChunk struct {
+	start, end int
+	lines      []string
+}
+
+// mergeChunks returns the changes that turn base into text, in order.
+func mergeChunks(base, text string) (chunks []mergeChunk) {
+	pos := 0
+	var current *mergeChunk
+	for _, op := range diffLines(base, text) {
+		line := op.text
+		if !op.noNewline {
+			line += "\n"
+		}
+		if op.op == ' ' {
+			if current != nil {
+				chunks = append(chunks, *current)
+				current = nil
+			}
+			pos++
+			continue
+		}
+		if current == nil {
+			current = &mergeChunk{start: pos, end: pos}
+		}
+		if op.op == '-' {
+			pos++
+			current.end = pos
+		} else {
+			current.lines = append(current.lines, line)
+		}
+	}
+	if current != nil {
+		chunks = append(chunks, *current)
+	}
+	return
+}
+
+// applyChunks returns the base lines [start, end) with the changes applied.
+func applyChunks(baseLines []string, start, end int, chunks []mergeChunk) (lines []string) {
+	pos := start
+	for _, chunk := range chunks {
+		lines = append(lines, baseLines[pos:chunk.start]...)
+		lines = append(lines, chunk.lines...)
+		pos = chunk.end
+	}
+	return append(lines, baseLines[pos:end]...)
+}
+
+// merge3 merges the changes from base to local and from base to remote.
+// Changes that overlap or touch are conflicts unless they are the same, and
+// are marked in the merged text.
+func merge3(base, local, remote string) (merged string, conflicts int) {
+	baseLines := splitLines(base)
+	sides := [2][]mergeChunk{mergeChunks(base, local), mergeChunks(base, remote)}
+	var out []string
+	pos := 0
+	for len(sides[0]) > 0 || len(sides[1]) > 0 {
+		// start a group of overlapping changes with the first change
+		first := 0
+		if len(sides[0]) == 0 || (len(sides[1]) > 0 && sides[1][0].start < sides[0][0].start) {
+			first = 1
+		}
+		start, end := sides[first][0].start, sides[first][0].end
+		var group [2][]mergeChunk
+		for grew := true; grew; {
+			grew = false
+			for i := range sides {
+				for len(sides[i]) > 0 && sides[i][0].start <= end {
+					chunk := sides[i][0]
+					sides[i] = sides[i][1:]
+					group[i] = append(group[i], chunk)
+					if chunk.end > end {
+						end = chunk.end
+					}
+					grew = true
+				}
+			}
+		}
+
+		out = append(out, baseLines[pos:start]...)
+		pos = end
+		if len(group[0]) == 0 || len(group[1]) == 0 {
+			out = append(out, applyChunks(baseLines, start, end, append(group[0], group[1]...))...)
+			continue
+		}
+		localLines := applyChunks(baseLines, start, end, group[0])
+		remoteLines := applyChunks(baseLines, start, end, group[1])
+		if strings.Join(localLines, "") == strings.Join(remoteLines, "") {
+			out = append(out, localLines...)
+			continue
+		}
+		conflicts++
+		out = append(out, "<<<<<<< local\n")
+		out = append(out, withNewline(localLines)...)
+		out = append(out, "=======\n")
+		out = append(out, withNewline(remoteLines)...)
+		out = append(out, ">>>>>>> remote\n")
+	}
+	out = append(out, baseLines[pos:]...)
+	merged = strings.Join(out, "")
+	return
+}
+
+// countConflicts returns the number of conflicts that are still marked in
+// the text.
+func countConflicts(text string) (conflicts int) {
+	marker := 0
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case line == "<<<<<<< local":
+			marker = 1
+		case line == "=======" && marker == 1:
+			marker = 2
+		case line == ">>>>>>> remote" && marker == 2:
+			marker = 0
+			conflicts++
+		}
+	}
+	return
+}
+
+// withNewline makes sure that the last line ends with a newline, so that a
+// conflict marker can follow it.
+func withNewline(lines []string) []string {
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines
+}
+
+// getRemoteText returns the exact text of the file on the server.
+func getRemoteText(address, username, filename string) (text string, err error) {
+	target, err := postToServerRetry(address+"/restore", serverRequest{
+		Username: username,
+		Filename: filename,
+	})
+	if err != nil {
+		return
+	}
+	return decompressPatch(string(target.Data))
+}
+
+// Sync synchronizes a file with the server in both directions. Changes made
+// on the server since the last sync are merged into the local file, and the
+// merged file is patched up. It returns the number of conflicts, which are
+// marked in the local file and are not uploaded.
+func Sync(address, username, pathToFile string, opts Options) (conflicts int, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	address, username = c.ServerAddress, c.Username
+	if opts.Compression == "" {
+		opts.Compression = c.Compression
+	}
+	opts.diffAlgorithms = c.DiffAlgorithms
+	_, filename := filepath.Split(pathToFile)
+
+	pathToRemoteCopy := pathToCachedCopy(address, username, filename)
+	os.MkdirAll(filepath.Dir(pathToRemoteCopy), 0755)
+	// a file that is not here yet (e.g. on a new device) only gets the
+	// changes from the server, and a file that was never synced here has
+	// no base
+	var localText, baseText string
+	hasBase := false
+	if Exists(pathToFile) {
+		localText, err = getFileText(pathToFile)
+		if err != nil {
+			return
+		}
+		// the base is already the remote copy of the conflicts, so the
+		// markers would be uploaded as a change
+		conflicts = countConflicts(localText)
+		if conflicts > 0 {
+			err = fmt.Errorf("%d conflicts in '%s', resolve them and sync again", conflicts, pathToFile)
+			return
+		}
+		if Exists(pathToRemoteCopy) {
+			baseText, err = getFileText(pathToRemoteCopy)
+			if err != nil {
+				return
+			}
+			hasBase = true
+		}
+	}
+
+	// detect changes on the server since the last sync
+	remoteHash, err := getLatestHash(address, username, filename)
+	if err != nil {
+		return
+	}
+	baseHash, _ := Filemd5Sum(pathToRemoteCopy)
+	remoteText := baseText
+	if !hasBase || remoteHash != baseHash {
+		log.Debug("remote changed since the last sync, getting it")
+		remoteText, err = getRemoteText(address, username, filename)
+		if err != nil {
+			err = errors.Wrap(err, "problem getting the remote copy")
+			return
+		}
+	}
+
+	switch {
+	case localText == remoteText:
+		log.Infof("'%s' is in sync", filename)
+		if !opts.DryRun {
+			err = ioutil.WriteFile(pathToRemoteCopy, []byte(remoteText), 0755)
+		}
+		return
+	case remoteText == baseText:
+		// only the local file changed
+		return 0, patchUp(address, username, pathToFile, filename, opts)
+	}
+
+	merged := remoteText
+	if localText != baseText {
+		merged, conflicts = merge3(baseText, localText, remoteText)
+	}
+	if opts.DryRun {
+		log.Infof("would merge the changes to '%s' on the server with %d conflicts", filename, conflicts)
+		return
+	}
+	// the remote copy is now the base of the next sync
+	err = ioutil.WriteFile(pathToRemoteCopy, []byte(remoteText), 0755)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(pathToFile, []byte(merged), 0755)
+	if err != nil {
+		return
+	}
+	if conflicts > 0 {
+		err = fmt.Errorf("%d conflicts in '%s', resolve them and sync again", conflicts, pathToFile)
+		return
+	}
+	if merged == remoteText {
+		log.Infof("pulled the changes to '%s' from the server", filename)
+		return
+	}
+	log.Infof("merged the changes to '%s' from the server", filename)
+	err = patchUp(address, username, pathToFile, filename, opts)
+	return
+}
@@ -0,0 +1,405 @@
+package patchitup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Revisions can be tagged with a name and a message, e.g. to mark the state
+// of a file before a migration. The tags of a file are kept next to it in
+// .<file>.tags, and a tag can be used wherever a revision or time is
+// expected. Tagged revisions are never pruned.
+
+// TagInfo is a named revision of a file.
+type TagInfo struct {
+	Name     string `json:"name"`
+	Message  string `json:"message,omitempty"`
+	Revision int64  `json:"revision"`
+	// Created is when the tag was made, in unix milliseconds
+	Created int64 `json:"created"`
+}
+
+func pathToTags(pathToFile string) string {
+	folder, filename := filepath.Split(pathToFile)
+	return filepath.Join(folder, "."+filename+".tags")
+}
+
+// listTags returns the tags of a file in order of their revisions.
+func listTags(pathToFile string) (tags []TagInfo, err error) {
+	bTags, err := ioutil.ReadFile(pathToTags(pathToFile))
+	if err != nil {
+		// no tags
+		err = nil
+		return
+	}
+	err = json.Unmarshal(bTags, &tags)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Revision < tags[j].Revision })
+	return
+}
+
+// getTag returns the tag of a file with the name.
+func getTag(pathToFile, name string) (tag TagInfo, ok bool) {
+	tags, _ := listTags(pathToFile)
+	for _, tag = range tags {
+		if tag.Name == name {
+			return tag, true
+		}
+	}
+	return TagInfo{}, false
+}
+
+// tagRevision tags a revision of a file, moving the tag if it already exists.
+func tagRevision(pathToFile, name, message string, revision int64) (err error) {
+	err = validateTagName(name)
+	if err != nil {
+		return
+	}
+	if !Exists(pathToRevision(pathToFile, revision)) {
+		return fmt.Errorf("revision %d not found", revision)
+	}
+	tags, err := listTags(pathToFile)
+	if err != nil {
+		return
+	}
+	newTags := []TagInfo{{
+		Name:     name,
+		Message:  message,
+		Revision: revision,
+		Created:  time.Now().UnixNano() / 1000000,
+	}}
+	for _, tag := range tags {
+		if tag.Name != name {
+			newTags = append(newTags, tag)
+		}
+	}
+	bTags, err := json.Marshal(newTags)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(pathToTags(pathToFile), bTags, 0755)
+}
+
+// validateTagName returns an error if the name can not be a tag.
+func validateTagName(name string) error {
+	err := validateNames(name)
+	if err != nil {
+		return err
+	}
+	if _, errParse := strconv.ParseInt(name, 10, 64); errParse == nil {
+		return fmt.Errorf("tag '%s' can not be a number", name)
+	}
+	return nil
+}
+
+// tagLatestRevision tags the latest revision of a file.
+func tagLatestRevision(pathToFile, name, message string) (revision int64, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	if len(revisions) == 0 {
+		err = errors.New("no revisions to tag")
+		return
+	}
+	revision = revisions[len(revisions)-1]
+	err = tagRevision(pathToFile, name, message, revision)
+	return
+}
+
+// resolveRevision returns the revision of a tag, or the latest revision at
+// or before a time.
+func resolveRevision(pathToFile, at string) (revision int64, err error) {
+	if tag, ok := getTag(pathToFile, at); ok {
+		revision = tag.Revision
+		return
+	}
+	millis, err := parseRevisionTime(at)
+	if err != nil {
+		return
+	}
+	return getRevisionAt(pathToFile, millis)
+}
+
+// pruneRevisions removes the revisions of a file before the time (in unix
+// milliseconds, or 0 for any time) except for the latest keep revisions
+// and the protected ones. The changes of the removed revisions are squashed
+// into the next revision that is kept, so every kept revision can still be
+// restored.
+func pruneRevisions(pathToFile string, before int64, keep int, protected map[int64]bool) (pruned int, err error) {
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	var removed []int64
+	// pending is set when revisions were removed since the last kept one
+	pending := false
+	squashed := make(map[int64]string)
+	text, keptText := "", ""
+	for i, r := range revisions {
+		compressedPatch, errRead := ioutil.ReadFile(pathToRevision(pathToFile, r))
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		patch, d, errPatch := readPatch(string(compressedPatch))
+		if errPatch != nil {
+			err = errors.Wrapf(errPatch, "problem reading revision %d", r)
+			return
+		}
+		text, err = d.Apply(text, patch)
+		if err != nil {
+			return
+		}
+		keepRevision := protected[r] || i >= len(revisions)-keep || i == len(revisions)-1 || (before > 0 && r >= before)
+		if !keepRevision {
+			removed = append(removed, r)
+			pending = true
+			continue
+		}
+		if pending {
+			pending = false
+			d = chooseDiffer(filename, len(text), "", nil, serverCapabilities())
+			squashed[r], err = compressPatchWith(d.Diff(filename, keptText, text), gzipCodec{}, d)
+			if err != nil {
+				return
+			}
+		}
+		keptText = text
+	}
+
+	// replace the revisions that the removed ones are squashed into first
+	for r, compressedPatch := range squashed {
+		pathToTemp := pathToRevision(pathToFile, r) + ".temp"
+		err = ioutil.WriteFile(pathToTemp, []byte(compressedPatch), 0755)
+		if err != nil {
+			return
+		}
+		err = os.Rename(pathToTemp, pathToRevision(pathToFile, r))
+		if err != nil {
+			return
+		}
+	}
+	for _, r := range removed {
+		err = os.Remove(pathToRevision(pathToFile, r))
+		if err != nil {
+			return
+		}
+		pruned++
+	}
+	return
+}
+
+func handlerTag(c *gin.Context) {
+	revision, message, err := func(c *gin.Context) (revision int64, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		unlock := lockUser(sr.Username)
+		defer unlock()
+		if sr.At == "" {
+			revision, err = tagLatestRevision(pathToFile, sr.Tag, sr.Message)
+		} else {
+			revision, err = resolveRevision(pathToFile, sr.At)
+			if err == nil {
+				err = tagRevision(pathToFile, sr.Tag, sr.Message, revision)
+			}
+		}
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s tagged revision %d as '%s'", sr.Username, sr.Filename, revision, sr.Tag)
+		message = fmt.Sprintf("tagged revision %d", revision)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:  message,
+		Success:  err == nil,
+		Revision: revision,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+func handlerTags(c *gin.Context) {
+	tags, message, err := func(c *gin.Context) (tags []TagInfo, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		tags, err = listTags(pathToFile)
+		message = fmt.Sprintf("%d tags", len(tags))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+		Tags:    tags,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// protectedRevisions returns the revisions of a file that are not pruned,
+// which are the tagged revisions and the revisions of commits.
+func protectedRevisions(folder, username, filename, pathToFile string) (protected map[int64]bool, err error) {
+	protected = make(map[int64]bool)
+	tags, err := listTags(pathToFile)
+	if err != nil {
+		return
+	}
+	for _, tag := range tags {
+		protected[tag.Revision] = true
+	}
+	commits, err := listCommits(folder, username, filename)
+	if err != nil {
+		return
+	}
+	for _, commit := range commits {
+		protected[commit.Revision] = true
+	}
+	return
+}
+
+func handlerPrune(c *gin.Context) {
+	message, err := func(c *gin.Context) (message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		pathToFile, err := pathToServerFile(dataDir(c), sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		var before int64
+		if sr.At != "" {
+			before, err = parseRevisionTime(sr.At)
+			if err != nil {
+				return
+			}
+		}
+
+		unlock := lockUser(sr.Username)
+		defer unlock()
+		protected, err := protectedRevisions(dataDir(c), sr.Username, sr.Filename, pathToFile)
+		if err != nil {
+			return
+		}
+		pruned, err := pruneRevisions(pathToFile, before, sr.Keep, protected)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s pruned %d revisions", sr.Username, sr.Filename, pruned)
+		message = fmt.Sprintf("pruned %d revisions", pruned)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message: message,
+		Success: err == nil,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// Tag tags the revision of a file on the server at a time or revision, or
+// the latest revision if at is empty.
+func Tag(address, username, pathToFile, name, message, at string) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureTags)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	target, err := postToServerRetry(c.ServerAddress+"/tag", serverRequest{
+		Username: c.Username,
+		Filename: filename,
+		Tag:      name,
+		Message:  message,
+		At:       at,
+	})
+	if err != nil {
+		return
+	}
+	log.Infof("tagged revision %d of '%s' as '%s'", target.Revision, filename, name)
+	return
+}
+
+// ListTags returns the tags of a file on the server.
+func ListTags(address, username, pathToFile string) (tags []TagInfo, err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureTags)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	target, err := postToServerRetry(c.ServerAddress+"/tags", serverRequest{
+		Username: c.Username,
+		Filename: filename,
+	})
+	tags = target.Tags
+	return
+}
+
+// Prune squashes the revisions of a file on the server from before a time
+// (or any time if before is empty), keeping the latest keep revisions and
+// every tagged revision.
+func Prune(address, username, pathToFile string, keep int, before string) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureTags)
+	if err != nil {
+		return
+	}
+	_, filename := filepath.Split(pathToFile)
+	target, err := postToServerRetry(c.ServerAddress+"/prune", serverRequest{
+		Username: c.Username,
+		Filename: filename,
+		Keep:     keep,
+		At:       before,
+	})
+	if err != nil {
+		return
+	}
+	log.Infof("%s of '%s'", target.Message, filename)
+	return
+}
@@ -0,0 +1,333 @@
+package patchitup
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// A server runs with TLS when it is started with SetTLS. Its certificate
+// and key are configured in .tls.toml in the server folder, like
+//
+//   Cert = "/etc/patchitup/cert.pem"
+//   Key = "/etc/patchitup/key.pem"
+//
+// and are otherwise generated (self-signed) on the first run. If ClientCA is
+// set, clients must present a certificate signed by it, and can only act as
+// the user named by the common name of the certificate (or the username it
+// maps to in Users).
+//
+// A client pins the certificate authority of a server with CA in
+// config.toml, and presents its own certificate with Cert and Key.
+
+// tlsConfiguration is the TLS configuration of the server
+type tlsConfiguration struct {
+	// Enabled runs the server with TLS, when set in the server configuration
+	Enabled bool `toml:",omitempty"`
+	Cert    string
+	Key     string
+	// ClientCA is the certificate authority of client certificates
+	ClientCA string
+	// Users maps the common names of client certificates to usernames
+	Users map[string]string
+}
+
+// serverTLS determines whether the server runs with TLS
+var serverTLS bool
+
+// certificateUsers maps the common names of client certificates to
+// usernames, as configured
+var certificateUsers = struct {
+	sync.RWMutex
+	users map[string]string
+}{}
+
+// SetTLS determines whether the server runs with TLS.
+func SetTLS(enabled bool) {
+	serverTLS = enabled
+}
+
+func pathToTLS() string {
+	return path.Join(getServerDataDir(), ".tls.toml")
+}
+
+// loadTLS reads the TLS configuration of the server, unless it is in the
+// server configuration, and generates a self-signed certificate if none is
+// configured.
+func loadTLS(configured *tlsConfiguration) (config tlsConfiguration, err error) {
+	if configured != nil {
+		config = *configured
+	} else if Exists(pathToTLS()) {
+		_, err = toml.DecodeFile(pathToTLS(), &config)
+		if err != nil {
+			return
+		}
+	}
+	err = config.validate()
+	if err != nil {
+		return
+	}
+	if config.Cert == "" {
+		config.Cert = path.Join(getServerDataDir(), ".tls", "cert.pem")
+		config.Key = path.Join(getServerDataDir(), ".tls", "key.pem")
+		if !Exists(config.Cert) {
+			hostname, _ := os.Hostname()
+			err = generateCertificate(config.Cert, config.Key, "patchitup", []string{"localhost", "127.0.0.1", hostname})
+			if err != nil {
+				return
+			}
+			log.Infof("generated a self-signed certificate, pin it on the clients with CA = '%s'", config.Cert)
+		}
+	}
+	certificateUsers.Lock()
+	certificateUsers.users = config.Users
+	certificateUsers.Unlock()
+	return
+}
+
+func (config tlsConfiguration) validate() error {
+	if (config.Cert == "") != (config.Key == "") {
+		return errors.New("both Cert and Key of TLS must be set")
+	}
+	return nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server, which
+// requires client certificates if a client CA is configured.
+func serverTLSConfig(config tlsConfiguration) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.ClientCA == "" {
+		return
+	}
+	pool, err := loadCertPool(config.ClientCA)
+	if err != nil {
+		return
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return
+}
+
+// runTLS runs the router with TLS.
+func runTLS(r *gin.Engine, listen string, configured *tlsConfiguration) (err error) {
+	config, err := loadTLS(configured)
+	if err != nil {
+		return
+	}
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return
+	}
+	s := &http.Server{
+		Addr:      listen,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	return s.ListenAndServeTLS(config.Cert, config.Key)
+}
+
+// generateCertificate writes a self-signed certificate for the hosts, which
+// is its own certificate authority, and its key.
+func generateCertificate(pathToCert, pathToKey, commonName string, hosts []string) (err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	bCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	bKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(path.Dir(pathToCert), 0755)
+	os.MkdirAll(path.Dir(pathToKey), 0755)
+	err = ioutil.WriteFile(pathToCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bCert}), 0644)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(pathToKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bKey}), 0600)
+}
+
+// loadCertPool reads the certificates in a PEM file.
+func loadCertPool(pathToCA string) (pool *x509.CertPool, err error) {
+	bCA, err := ioutil.ReadFile(pathToCA)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bCA) {
+		err = fmt.Errorf("no certificates in '%s'", pathToCA)
+	}
+	return
+}
+
+// certificateUser returns the user of the client certificate of the
+// request, if there is one.
+func certificateUser(c *gin.Context) (username string, ok bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return
+	}
+	username = c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+	certificateUsers.RLock()
+	if user, mapped := certificateUsers.users[username]; mapped {
+		username = user
+	}
+	certificateUsers.RUnlock()
+	return username, true
+}
+
+// checkCertificateUser returns an error if the request has a client
+// certificate of another user.
+func checkCertificateUser(c *gin.Context, username string) error {
+	user, ok := certificateUser(c)
+	if ok && user != username {
+		return fmt.Errorf("certificate of '%s' can not be used for '%s'", user, username)
+	}
+	return nil
+}
+
+// clientTLS are the TLS configurations of the servers, by host
+var clientTLS = struct {
+	sync.Mutex
+	configs   map[string]*tls.Config
+	transport *http.Transport
+}{configs: make(map[string]*tls.Config)}
+
+// setClientTLS configures the pinned certificate authority and the client
+// certificate of the server of the configuration.
+func setClientTLS(c clientConfiguration) (err error) {
+	if c.CA == "" && c.Cert == "" {
+		return
+	}
+	host, tlsConfig, err := clientTLSConfig(c)
+	if err != nil {
+		return
+	}
+	setHostTLS(host, tlsConfig)
+	clientTLS.Lock()
+	defer clientTLS.Unlock()
+	if clientTLS.transport == nil {
+		clientTLS.transport = newClientTransport()
+		httpClient.Transport = clientTLS.transport
+	}
+	return
+}
+
+// clientTLSConfig loads the pinned certificate authority and the client
+// certificate of the configuration, for the host of its server.
+func clientTLSConfig(c clientConfiguration) (host string, tlsConfig *tls.Config, err error) {
+	u, err := url.Parse(c.ServerAddress)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "https" {
+		err = fmt.Errorf("CA and Cert need an https server address, not '%s'", c.ServerAddress)
+		return
+	}
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CA != "" {
+		tlsConfig.RootCAs, err = loadCertPool(c.CA)
+		if err != nil {
+			return
+		}
+	}
+	if c.Cert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			err = errors.Wrap(err, "problem loading client certificate")
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	host = u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	return
+}
+
+// setHostTLS sets the TLS configuration that connections to the host use.
+func setHostTLS(host string, tlsConfig *tls.Config) {
+	clientTLS.Lock()
+	clientTLS.configs[host] = tlsConfig
+	clientTLS.Unlock()
+}
+
+// newClientTransport returns a transport that connects to each server with
+// its TLS configuration.
+func newClientTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = dialTLS
+	return transport
+}
+
+// dialTLS connects to a server with its TLS configuration, if it has one.
+func dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	clientTLS.Lock()
+	tlsConfig, ok := clientTLS.configs[addr]
+	clientTLS.Unlock()
+	if ok {
+		tlsConfig = tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	d := tls.Dialer{Config: tlsConfig}
+	return d.DialContext(ctx, network, addr)
+}
+
+// isCertificateError returns whether the connection failed because of a
+// certificate, which is not fixed by trying again. The server refusing the
+// certificate of the client is a remote TLS alert.
+func isCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	return errors.As(err, &verifyErr) || (errors.As(err, &opErr) && opErr.Op == "remote error")
+}
@@ -0,0 +1,126 @@
+package patchitup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requests are sent to the server over a transport. Besides HTTP, a server
+// address can be a local or mounted directory like file:///mnt/backup,
+// which is then used as the storage of the server without running one. The
+// requests to a directory are handled by the same handlers as a server, so
+// the files and their revisions are kept the same way.
+
+// transport sends a request to a server
+type transport interface {
+	do(req *http.Request) (*http.Response, error)
+}
+
+// fileScheme is the scheme of the addresses of local directories
+const fileScheme = "file://"
+
+// getTransport returns the transport of the server address.
+func getTransport(address string) transport {
+	if strings.HasPrefix(address, fileScheme) {
+		return localTransport{}
+	}
+	return httpTransport{}
+}
+
+// httpTransport sends requests to a server over HTTP
+type httpTransport struct{}
+
+func (httpTransport) do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), getRequestSettings(req.URL.String()).timeout)
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout lasts until the body is read
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a response when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// localTransport handles requests with the storage in a local directory
+type localTransport struct{}
+
+// local has the routers that handle the requests to local directories, one
+// for each directory, which keeps its files there.
+var local = struct {
+	sync.Mutex
+	once    sync.Once
+	routers map[string]*gin.Engine
+	routes  []string
+}{routers: make(map[string]*gin.Engine)}
+
+// localRouter returns the router of the directory.
+func localRouter(folder string) *gin.Engine {
+	local.Lock()
+	defer local.Unlock()
+	router, ok := local.routers[folder]
+	if !ok {
+		router = newRouter(folder)
+		local.routers[folder] = router
+	}
+	return router
+}
+
+func (localTransport) do(req *http.Request) (resp *http.Response, err error) {
+	local.once.Do(func() {
+		for _, route := range newRouter("").Routes() {
+			local.routes = append(local.routes, route.Path)
+		}
+		// the longest routes are matched first, e.g. /upload/commit before /commit
+		sort.Slice(local.routes, func(i, j int) bool { return len(local.routes[i]) > len(local.routes[j]) })
+	})
+	folder, route := splitLocalAddress(req.URL)
+	if route == "/events" {
+		return nil, errors.New("events are not supported for local directories")
+	}
+	// the directory is not made, so that an unmounted directory is like a
+	// server that can not be reached
+	if !Exists(folder) {
+		return nil, unreachableError{fmt.Errorf("'%s' not found", folder)}
+	}
+
+	r := req.Clone(req.Context())
+	r.URL = &url.URL{Path: route, RawQuery: req.URL.RawQuery}
+	w := httptest.NewRecorder()
+	localRouter(folder).ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// splitLocalAddress splits the URL of a request to a local directory into
+// the directory and the route.
+func splitLocalAddress(u *url.URL) (folder, route string) {
+	p := u.Host + u.Path
+	for _, r := range local.routes {
+		if strings.HasSuffix(p, r) {
+			return strings.TrimSuffix(p, r), r
+		}
+	}
+	return p, "/"
+}
@@ -0,0 +1,465 @@
+package patchitup
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+)
+
+// The server has a read-only web UI at /ui/ for browsing the files of the
+// users and their revisions. It is only served over TLS. A user signs in
+// with their client certificate, or with their username and a password for
+// the UI, and can only see their own files. The passwords of the users and
+// the admins of the UI are configured in the server configuration, like
+//
+//   [UI.Users]
+//   me = "a long password"
+//
+//   [UI.Admins]
+//   admin = "another long password"
+//
+// and admins can see the files of every user. The secrets that users sign
+// their requests with are not passwords for the UI, since they can change
+// the files. Without passwords or client certificates nobody can sign in.
+
+// uiConfiguration is the configuration of the web UI
+type uiConfiguration struct {
+	// Users are the passwords of the users, by username
+	Users map[string]string `toml:",omitempty"`
+	// Admins are the passwords of the admins, by name
+	Admins map[string]string `toml:",omitempty"`
+}
+
+var ui = struct {
+	sync.RWMutex
+	config uiConfiguration
+}{}
+
+func setUI(config uiConfiguration) {
+	ui.Lock()
+	ui.config = config
+	ui.Unlock()
+}
+
+// uiViewer is who is signed in to the web UI
+type uiViewer struct {
+	Username string
+	Admin    bool
+}
+
+// uiViewerKey is the key of the viewer in the context of a request
+const uiViewerKey = "uiViewer"
+
+// getUIViewer returns who is signed in with the request, if anyone.
+func getUIViewer(c *gin.Context) (viewer uiViewer, ok bool) {
+	if username, ok := certificateUser(c); ok {
+		return uiViewer{Username: username}, true
+	}
+	username, password, hasAuth := c.Request.BasicAuth()
+	if !hasAuth || password == "" {
+		return
+	}
+	ui.RLock()
+	admin, isAdmin := ui.config.Admins[username]
+	user, isUser := ui.config.Users[username]
+	ui.RUnlock()
+	if isAdmin && subtle.ConstantTimeCompare([]byte(admin), []byte(password)) == 1 {
+		return uiViewer{Username: username, Admin: true}, true
+	}
+	if isUser && subtle.ConstantTimeCompare([]byte(user), []byte(password)) == 1 {
+		return uiViewer{Username: username}, true
+	}
+	return uiViewer{}, false
+}
+
+// uiAuthHandler lets only those who are signed in see the web UI, and only
+// admins see the files of other users.
+func uiAuthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// passwords are sent with basic authentication, in the clear
+		// without TLS
+		if c.Request.TLS == nil {
+			c.String(http.StatusForbidden, "the web UI is only served over TLS")
+			c.Abort()
+			return
+		}
+		viewer, ok := getUIViewer(c)
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="patchitup"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if username := c.Param("username"); username != "" && !viewer.Admin && username != viewer.Username {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Set(uiViewerKey, viewer)
+		// the pages show files of the users, so they are not allowed to run
+		// anything or be framed
+		c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		c.Header("X-Frame-Options", "DENY")
+		c.Next()
+	}
+}
+
+// uiFile is a file of a user in the web UI
+type uiFile struct {
+	Name      string
+	Size      int64
+	Revisions int
+	Latest    int64
+}
+
+// uiRevision is a revision of a file in the web UI
+type uiRevision struct {
+	Revision  int64
+	Previous  int64
+	PatchSize int64
+	Tags      []string
+}
+
+// uiUser is a user in the web UI
+type uiUser struct {
+	Name  string
+	Files int
+	Size  int64
+	userBandwidth
+}
+
+// listUsers returns the users that have files in the data folder.
+func listUsers(folder string) (users []string, err error) {
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			users = append(users, entry.Name())
+		}
+	}
+	return
+}
+
+// listUserFiles returns the files of a user with their revisions.
+func listUserFiles(folder, username string) (files []uiFile, err error) {
+	entries, err := ioutil.ReadDir(path.Join(folder, username))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		revisions, ok := isTrackedFile(path.Join(folder, username), entry)
+		if !ok {
+			continue
+		}
+		files = append(files, uiFile{
+			Name:      entry.Name(),
+			Size:      entry.Size(),
+			Revisions: len(revisions),
+			Latest:    revisions[len(revisions)-1],
+		})
+	}
+	return
+}
+
+func handlerUIUsers(c *gin.Context) {
+	viewer := c.MustGet(uiViewerKey).(uiViewer)
+	if !viewer.Admin {
+		c.Redirect(http.StatusFound, "/ui/"+viewer.Username+"/")
+		return
+	}
+	names, err := listUsers(dataDir(c))
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	var users []uiUser
+	for _, name := range names {
+		files, _ := listUserFiles(dataDir(c), name)
+		u := uiUser{Name: name, Files: len(files), userBandwidth: getBandwidthOf(name)}
+		for _, f := range files {
+			u.Size += f.Size
+		}
+		users = append(users, u)
+	}
+	renderUI(c, "users", gin.H{"Viewer": viewer, "Users": users})
+}
+
+func handlerUIFiles(c *gin.Context) {
+	username := c.Param("username")
+	if err := validateNames(username); err != nil {
+		renderUIError(c, err)
+		return
+	}
+	files, err := listUserFiles(dataDir(c), username)
+	if err != nil && !os.IsNotExist(err) {
+		renderUIError(c, err)
+		return
+	}
+	renderUI(c, "files", gin.H{
+		"Viewer":    c.MustGet(uiViewerKey),
+		"Username":  username,
+		"Files":     files,
+		"Bandwidth": getBandwidthOf(username),
+	})
+}
+
+func handlerUIFile(c *gin.Context) {
+	username, filename := c.Param("username"), c.Param("filename")
+	pathToFile, err := pathToServerFile(dataDir(c), username, filename)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	stat, err := os.Stat(pathToFile)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	revisions, err := listRevisions(pathToFile)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	tags, err := listTags(pathToFile)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	tagged := make(map[int64][]string)
+	for _, tag := range tags {
+		tagged[tag.Revision] = append(tagged[tag.Revision], tag.Name)
+	}
+	// the timeline starts with the latest revision
+	timeline := make([]uiRevision, len(revisions))
+	for i, r := range revisions {
+		rev := uiRevision{Revision: r, Tags: tagged[r]}
+		if i > 0 {
+			rev.Previous = revisions[i-1]
+		}
+		if patchStat, errStat := os.Stat(pathToRevision(pathToFile, r)); errStat == nil {
+			rev.PatchSize = patchStat.Size()
+		}
+		timeline[len(revisions)-1-i] = rev
+	}
+	renderUI(c, "file", gin.H{
+		"Viewer":    c.MustGet(uiViewerKey),
+		"Username":  username,
+		"Filename":  filename,
+		"Size":      stat.Size(),
+		"Revisions": timeline,
+	})
+}
+
+func handlerUIDiff(c *gin.Context) {
+	username, filename := c.Param("username"), c.Param("filename")
+	from, to := c.Query("from"), c.Query("to")
+	pathToFile, err := pathToServerFile(dataDir(c), username, filename)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	fromText, err := getTextAt(pathToFile, from)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	toText, err := getTextAt(pathToFile, to)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	_, hunks := unifiedDiff(revisionName(filename, from), revisionName(filename, to), fromText, toText)
+	renderUI(c, "diff", gin.H{
+		"Viewer":   c.MustGet(uiViewerKey),
+		"Username": username,
+		"Filename": filename,
+		"From":     revisionName(filename, from),
+		"To":       revisionName(filename, to),
+		"Hunks":    hunks,
+	})
+}
+
+func handlerUIDownload(c *gin.Context) {
+	username, filename := c.Param("username"), c.Param("filename")
+	revision := c.Query("revision")
+	pathToFile, err := pathToServerFile(dataDir(c), username, filename)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	text, err := getTextAt(pathToFile, revision)
+	if err != nil {
+		renderUIError(c, err)
+		return
+	}
+	name := filename
+	if revision != "" && revision != "current" {
+		name = fmt.Sprintf("%s.%s", filename, revision)
+	}
+	log.Infof("%s/%s download %s", username, filename, revisionName(filename, revision))
+	// the file is always downloaded, and never shown as a page of the server
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Data(http.StatusOK, "application/octet-stream", []byte(text))
+}
+
+func renderUI(c *gin.Context, page string, data gin.H) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", contentType(page+".html")+"; charset=utf-8")
+	err := uiTemplates.ExecuteTemplate(c.Writer, page, data)
+	if err != nil {
+		log.Warnf("problem rendering %s: %s", page, err)
+	}
+}
+
+func renderUIError(c *gin.Context, err error) {
+	c.Status(http.StatusNotFound)
+	c.Header("Content-Type", contentType("error.html")+"; charset=utf-8")
+	uiTemplates.ExecuteTemplate(c.Writer, "error", gin.H{
+		"Viewer": c.MustGet(uiViewerKey),
+		"Error":  err.Error(),
+	})
+}
+
+// userBandwidth is the number of requests of a user to the server and their
+// size, since the server started
+type userBandwidth struct {
+	Requests int
+	Received int64
+	Sent     int64
+}
+
+var serverBandwidth = struct {
+	sync.Mutex
+	users map[string]userBandwidth
+}{users: make(map[string]userBandwidth)}
+
+// addBandwidthOf counts a request of a user, where a size is negative if
+// it is not known.
+func addBandwidthOf(username string, received, sent int64) {
+	if received < 0 {
+		received = 0
+	}
+	if sent < 0 {
+		sent = 0
+	}
+	serverBandwidth.Lock()
+	b := serverBandwidth.users[username]
+	b.Requests++
+	b.Received += received
+	b.Sent += sent
+	serverBandwidth.users[username] = b
+	serverBandwidth.Unlock()
+}
+
+func getBandwidthOf(username string) userBandwidth {
+	serverBandwidth.Lock()
+	defer serverBandwidth.Unlock()
+	return serverBandwidth.users[username]
+}
+
+var uiFuncs = template.FuncMap{
+	"bytes": func(size int64) string {
+		return humanize.Bytes(uint64(size))
+	},
+	"time": func(millis int64) string {
+		return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+	"ago": func(millis int64) string {
+		return humanize.Time(time.Unix(0, millis*int64(time.Millisecond)))
+	},
+	"line": func(line string) string {
+		switch {
+		case strings.HasPrefix(line, "+"):
+			return "add"
+		case strings.HasPrefix(line, "-"):
+			return "del"
+		}
+		return ""
+	},
+	"sorted": func(tags []string) []string {
+		sort.Strings(tags)
+		return tags
+	},
+}
+
+var uiTemplates = template.Must(template.New("ui").Funcs(uiFuncs).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>patchitup</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; }
+.num { text-align: right; }
+.tag { background: #eef; border-radius: 3px; padding: 0 0.3em; margin-right: 0.3em; }
+pre { background: #f7f7f7; padding: 0.5em; overflow-x: auto; }
+.add { background: #e6ffed; }
+.del { background: #ffeef0; }
+.hunk { color: #888; }
+nav { margin-bottom: 1em; color: #888; }
+</style>
+</head>
+<body>
+<nav><a href="/ui/">patchitup</a>{{if .Username}} / <a href="/ui/{{.Username}}/">{{.Username}}</a>{{end}}{{if .Filename}} / <a href="/ui/{{.Username}}/{{.Filename}}">{{.Filename}}</a>{{end}} &middot; signed in as {{.Viewer.Username}}</nav>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "users"}}{{template "header" .}}
+<h1>Users</h1>
+<table>
+<tr><th>User</th><th class="num">Files</th><th class="num">Size</th><th class="num">Requests</th><th class="num">Received</th><th class="num">Sent</th></tr>
+{{range .Users}}<tr><td><a href="/ui/{{.Name}}/">{{.Name}}</a></td><td class="num">{{.Files}}</td><td class="num">{{bytes .Size}}</td><td class="num">{{.Requests}}</td><td class="num">{{bytes .Received}}</td><td class="num">{{bytes .Sent}}</td></tr>
+{{end}}</table>
+<p>Bandwidth is counted since the server started.</p>
+{{template "footer"}}{{end}}
+
+{{define "files"}}{{template "header" .}}
+<h1>Files of {{.Username}}</h1>
+<table>
+<tr><th>File</th><th class="num">Size</th><th class="num">Revisions</th><th>Last changed</th></tr>
+{{range .Files}}<tr><td><a href="/ui/{{$.Username}}/{{.Name}}">{{.Name}}</a></td><td class="num">{{bytes .Size}}</td><td class="num">{{.Revisions}}</td><td title="{{time .Latest}}">{{ago .Latest}}</td></tr>
+{{else}}<tr><td colspan="4">No files yet.</td></tr>
+{{end}}</table>
+<p>{{.Bandwidth.Requests}} requests, {{bytes .Bandwidth.Received}} received and {{bytes .Bandwidth.Sent}} sent since the server started.</p>
+{{template "footer"}}{{end}}
+
+{{define "file"}}{{template "header" .}}
+<h1>{{.Filename}}</h1>
+<p>{{bytes .Size}} with {{len .Revisions}} revisions. <a href="/ui/{{.Username}}/{{.Filename}}/download">Download</a></p>
+<table>
+<tr><th>Revision</th><th>Time</th><th class="num">Patch</th><th>Tags</th><th></th></tr>
+{{range .Revisions}}<tr><td>{{.Revision}}</td><td title="{{ago .Revision}}">{{time .Revision}}</td><td class="num">{{bytes .PatchSize}}</td><td>{{range sorted .Tags}}<span class="tag">{{.}}</span>{{end}}</td><td>{{if .Previous}}<a href="/ui/{{$.Username}}/{{$.Filename}}/diff?from={{.Previous}}&amp;to={{.Revision}}">changes</a> &middot; {{end}}<a href="/ui/{{$.Username}}/{{$.Filename}}/diff?from={{.Revision}}">since</a> &middot; <a href="/ui/{{$.Username}}/{{$.Filename}}/download?revision={{.Revision}}">download</a></td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "diff"}}{{template "header" .}}
+<h1>{{.From}} &rarr; {{.To}}</h1>
+{{range .Hunks}}<pre><span class="hunk">@@ -{{.FromLine}},{{.FromCount}} +{{.ToLine}},{{.ToCount}} @@</span>
+{{range .Lines}}<span class="{{line .}}">{{.}}</span>
+{{end}}</pre>
+{{else}}<p>No changes.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "error"}}{{template "header" .}}
+<h1>Not found</h1>
+<p>{{.Error}}</p>
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,325 @@
+package patchitup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Patches larger than chunkedUploadSize (e.g. the first upload of a large
+// file) are uploaded in chunks. The server stages the chunks of an upload
+// session until all of them are received, and then applies the patch. The
+// session is determined by the user, the file and the checksum of the patch,
+// so if an upload is interrupted the same patch resumes the same session.
+const (
+	chunkedUploadSize = 1024 * 1024
+	uploadChunkSize   = 256 * 1024
+	// uploadSessionExpiration is how long a stale session is kept around
+	uploadSessionExpiration = 7 * 24 * time.Hour
+)
+
+// uploadSession is the metadata of an upload session staged on the server.
+type uploadSession struct {
+	Username string `json:"username"`
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+func checksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func pathToUploadSession(folder, session string) string {
+	return path.Join(folder, ".staging", session)
+}
+
+// uploadPatchesChunked uploads a large patch in chunks, skipping any chunks
+// that the server already received.
+func uploadPatchesChunked(patch string, address, username, filename string, chunkSize int, tag, message string) (err error) {
+	sr := serverRequest{
+		Username: username,
+		Filename: filename,
+		Size:     len(patch),
+		Checksum: checksum([]byte(patch)),
+		Tag:      tag,
+		Message:  message,
+	}
+	target, err := postToServerRetry(address+"/upload/start", sr)
+	if err != nil {
+		return
+	}
+	sr.Session = target.Session
+	received := make(map[int]struct{})
+	for _, chunk := range target.Chunks {
+		received[chunk] = struct{}{}
+	}
+	if len(received) > 0 {
+		log.Infof("resuming upload of '%s' (%d chunks already uploaded)", filename, len(received))
+	}
+
+	for i := 0; i*chunkSize < len(patch); i++ {
+		if _, ok := received[i]; ok {
+			continue
+		}
+		end := (i + 1) * chunkSize
+		if end > len(patch) {
+			end = len(patch)
+		}
+		chunk := patch[i*chunkSize : end]
+		log.Debugf("uploading chunk %d (%s)", i, humanize.Bytes(uint64(len(chunk))))
+		_, err = postToServerRetry(address+"/upload/chunk", serverRequest{
+			Username: username,
+			Filename: filename,
+			Session:  sr.Session,
+			Chunk:    i,
+			Data:     base64String(chunk),
+			Checksum: checksum([]byte(chunk)),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "problem uploading chunk %d", i)
+		}
+	}
+
+	_, err = postToServer(address+"/upload/commit", sr)
+	return
+}
+
+func handlerUploadStart(c *gin.Context) {
+	session, chunks, message, err := func(c *gin.Context) (session string, chunks []int, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		err = validateNames(sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		if sr.Size <= 0 || len(sr.Checksum) != sha256.Size*2 {
+			err = errors.New("upload needs a size and checksum")
+			return
+		}
+		log.Infof("%s/%s upload session for %s", sr.Username, sr.Filename, humanize.Bytes(uint64(sr.Size)))
+		session = checksum([]byte(sr.Username + "/" + sr.Filename + "/" + sr.Checksum))[:32]
+		pathToSession := pathToUploadSession(dataDir(c), session)
+
+		// resume an existing session
+		if Exists(pathToSession) {
+			chunks, err = receivedChunks(dataDir(c), session)
+			message = fmt.Sprintf("resuming session with %d chunks", len(chunks))
+			return
+		}
+
+		err = os.MkdirAll(pathToSession, 0755)
+		if err != nil {
+			return
+		}
+		bSession, _ := json.Marshal(uploadSession{
+			Username: sr.Username,
+			Filename: sr.Filename,
+			Size:     sr.Size,
+			Checksum: sr.Checksum,
+		})
+		err = ioutil.WriteFile(path.Join(pathToSession, "session.json"), bSession, 0755)
+		message = "started session"
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sendResponse(c, serverResponse{
+		Message: message,
+		Success: err == nil,
+		Session: session,
+		Chunks:  chunks,
+	})
+}
+
+func handlerUploadChunk(c *gin.Context) {
+	message, err := func(c *gin.Context) (message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s upload chunk %d: %s", sr.Username, sr.Filename, sr.Chunk, humanize.Bytes(uint64(c.Request.ContentLength)))
+		us, err := getUploadSession(dataDir(c), sr.Session, sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		if sr.Chunk < 0 || sr.Chunk*uploadChunkSize >= us.Size {
+			err = fmt.Errorf("chunk %d out of range", sr.Chunk)
+			return
+		}
+		if checksum([]byte(sr.Data)) != sr.Checksum {
+			err = fmt.Errorf("checksum of chunk %d does not match", sr.Chunk)
+			return
+		}
+
+		// write the chunk atomically so a partial write is never counted as received
+		pathToChunk := path.Join(pathToUploadSession(dataDir(c), sr.Session), strconv.Itoa(sr.Chunk))
+		err = ioutil.WriteFile(pathToChunk+".temp", []byte(sr.Data), 0755)
+		if err != nil {
+			return
+		}
+		err = os.Rename(pathToChunk+".temp", pathToChunk)
+		message = fmt.Sprintf("received chunk %d", sr.Chunk)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sendResponse(c, serverResponse{
+		Message: message,
+		Success: err == nil,
+	})
+}
+
+func handlerUploadCommit(c *gin.Context) {
+	message, err := func(c *gin.Context) (message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		us, err := getUploadSession(dataDir(c), sr.Session, sr.Username, sr.Filename)
+		if err != nil {
+			return
+		}
+		// the tag is checked before the patch is applied
+		if sr.Tag != "" {
+			err = validateTagName(sr.Tag)
+			if err != nil {
+				return
+			}
+		}
+		chunks, err := receivedChunks(dataDir(c), sr.Session)
+		if err != nil {
+			return
+		}
+		numChunks := (us.Size + uploadChunkSize - 1) / uploadChunkSize
+		if len(chunks) != numChunks {
+			err = fmt.Errorf("received %d of %d chunks", len(chunks), numChunks)
+			return
+		}
+
+		// assemble the patch and make sure it is the one that was started
+		patch := make([]byte, 0, us.Size)
+		for _, chunk := range chunks {
+			var data []byte
+			data, err = ioutil.ReadFile(path.Join(pathToUploadSession(dataDir(c), sr.Session), strconv.Itoa(chunk)))
+			if err != nil {
+				return
+			}
+			patch = append(patch, data...)
+		}
+		if len(patch) != us.Size || checksum(patch) != us.Checksum {
+			err = errors.New("assembled upload does not match its checksum")
+			return
+		}
+
+		if !Exists(path.Join(dataDir(c), us.Username)) {
+			os.MkdirAll(path.Join(dataDir(c), us.Username), 0755)
+		}
+		pathToFile := path.Join(dataDir(c), us.Username, us.Filename)
+		if !Exists(pathToFile) {
+			var newFile *os.File
+			newFile, err = os.Create(pathToFile)
+			if err != nil {
+				err = errors.Wrap(err, "problem creating file")
+				return
+			}
+			newFile.Close()
+		}
+		unlock := lockUser(us.Username)
+		defer unlock()
+		baseHash := textHash(pathToFile)
+		err = patchFile(pathToFile, string(patch))
+		if err != nil {
+			return
+		}
+		log.Infof("%s/%s committed upload of %s", us.Username, us.Filename, humanize.Bytes(uint64(us.Size)))
+		os.RemoveAll(pathToUploadSession(dataDir(c), sr.Session))
+		message = "applied patch"
+		if sr.Tag != "" {
+			_, err = tagLatestRevision(pathToFile, sr.Tag, sr.Message)
+		}
+		publishPatch(us.Username, us.Filename, pathToFile, baseHash, us.Size)
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sendResponse(c, serverResponse{
+		Message: message,
+		Success: err == nil,
+	})
+}
+
+// getUploadSession loads an upload session and checks that it belongs to the
+// user and file.
+func getUploadSession(folder, session, username, filename string) (us uploadSession, err error) {
+	if session == "" || strings.ContainsAny(session, `./\`) {
+		err = errors.New("invalid session")
+		return
+	}
+	bSession, err := ioutil.ReadFile(path.Join(pathToUploadSession(folder, session), "session.json"))
+	if err != nil {
+		err = fmt.Errorf("session '%s' not found", session)
+		return
+	}
+	err = json.Unmarshal(bSession, &us)
+	if err != nil {
+		return
+	}
+	if us.Username != username || us.Filename != filename {
+		err = fmt.Errorf("session '%s' not found", session)
+	}
+	return
+}
+
+// receivedChunks returns the chunks of a session received so far, in order.
+func receivedChunks(folder, session string) (chunks []int, err error) {
+	files, err := ioutil.ReadDir(pathToUploadSession(folder, session))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		chunk, errParse := strconv.Atoi(f.Name())
+		if errParse == nil {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Ints(chunks)
+	return
+}
+
+// cleanUploadSessions removes the upload sessions in the data folder that
+// have not been touched in a while.
+func cleanUploadSessions(folder string) {
+	sessions, err := ioutil.ReadDir(path.Join(folder, ".staging"))
+	if err != nil {
+		return
+	}
+	for _, s := range sessions {
+		if time.Since(s.ModTime()) > uploadSessionExpiration {
+			log.Debugf("removing stale upload session %s", s.Name())
+			os.RemoveAll(pathToUploadSession(folder, s.Name()))
+		}
+	}
+}
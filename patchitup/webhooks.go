@@ -0,0 +1,421 @@
+package patchitup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/cihub/seelog"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+)
+
+// Webhooks are configured on the server in .webhooks.toml, e.g.
+//
+//   [[Webhook]]
+//   URL = "https://example.com/backups"
+//   Secret = "shared secret"
+//   Users = ["alice"]
+//   Files = ["*.sql"]
+//
+// Every event of a matching user and file (by default patches and new
+// files) is posted to the URL as JSON, signed with an HMAC-SHA256 of the
+// body using the secret in the X-Patchitup-Signature header. Deliveries
+// that fail are retried with exponential backoff, and every attempt is
+// recorded in the delivery log .webhooks.log, which keeps the latest
+// webhookLogKeep attempts of each webhook.
+
+// webhook is an outbound webhook configured on the server
+type webhook struct {
+	URL    string
+	Secret string
+	// Users are the users whose files trigger the webhook, or any user if empty
+	Users []string `toml:",omitempty"`
+	// Files are the patterns of the files that trigger the webhook, or any file if empty
+	Files []string `toml:",omitempty"`
+	// Events are the types of events that trigger the webhook, by default patch and create
+	Events []string `toml:",omitempty"`
+}
+
+// webhookDelivery is an attempt to deliver an event to a webhook
+type webhookDelivery struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Event   Event  `json:"event"`
+	Attempt int    `json:"attempt"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Time is when the attempt was made, in unix milliseconds
+	Time int64 `json:"time"`
+}
+
+// EventTest is the type of the event sent to test webhooks
+const EventTest = "test"
+
+// webhookRetries and webhookBackoff determine how failed deliveries are retried
+var (
+	webhookRetries = 5
+	webhookBackoff = 1 * time.Second
+)
+
+// webhookLogKeep is the number of attempts of each webhook that are kept in
+// the delivery log
+var webhookLogKeep = 100
+
+// webhookClient delivers the webhooks of the server, and webhookTestClient
+// delivers test events once with a short timeout so that the test answers
+// quickly
+var (
+	webhookClient     = &http.Client{Timeout: 30 * time.Second}
+	webhookTestClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+var webhooks = struct {
+	sync.RWMutex
+	list []webhook
+	// log guards writing the delivery log
+	log sync.Mutex
+	// recorded is the number of attempts recorded since the delivery log
+	// was compacted
+	recorded int
+}{}
+
+var startWebhooksOnce sync.Once
+
+func pathToWebhooks() string {
+	return path.Join(getServerDataDir(), ".webhooks.toml")
+}
+
+func pathToWebhookLog() string {
+	return path.Join(getServerDataDir(), ".webhooks.log")
+}
+
+// loadWebhooks loads the webhooks configured on the server.
+func loadWebhooks() (err error) {
+	list, err := readWebhooks()
+	if err != nil {
+		return
+	}
+	setWebhooks(list)
+	return
+}
+
+// readWebhooks reads and validates the webhooks configured on the server.
+func readWebhooks() (list []webhook, err error) {
+	var config struct {
+		Webhook []webhook
+	}
+	if Exists(pathToWebhooks()) {
+		_, err = toml.DecodeFile(pathToWebhooks(), &config)
+		if err != nil {
+			return
+		}
+	}
+	for _, w := range config.Webhook {
+		if w.URL == "" {
+			err = fmt.Errorf("webhook without URL in %s", pathToWebhooks())
+			return
+		}
+		if w.Secret == "" {
+			err = fmt.Errorf("webhook %s without Secret in %s", w.URL, pathToWebhooks())
+			return
+		}
+	}
+	list = config.Webhook
+	return
+}
+
+func setWebhooks(list []webhook) {
+	webhooks.Lock()
+	webhooks.list = list
+	webhooks.Unlock()
+	log.Infof("loaded %d webhooks", len(list))
+}
+
+// startWebhooks delivers the events of every user to the webhooks.
+func startWebhooks() {
+	startWebhooksOnce.Do(func() {
+		ch := events.subscribe(getServerDataDir(), "")
+		go func() {
+			for e := range ch {
+				for _, w := range matchingWebhooks(e) {
+					go deliverWebhook(w, e, webhookClient, webhookRetries)
+				}
+			}
+		}()
+	})
+}
+
+// matchingWebhooks returns the webhooks triggered by an event.
+func matchingWebhooks(e Event) (matching []webhook) {
+	webhooks.RLock()
+	defer webhooks.RUnlock()
+	for _, w := range webhooks.list {
+		if len(w.Users) > 0 && !contains(w.Users, e.Username) {
+			continue
+		}
+		types := w.Events
+		if len(types) == 0 {
+			types = []string{EventPatch, EventCreate}
+		}
+		if !contains(types, e.Type) && e.Type != EventTest {
+			continue
+		}
+		if len(w.Files) > 0 && e.Type != EventTest {
+			match := false
+			for _, pattern := range w.Files {
+				if ok, _ := filepath.Match(pattern, e.Filename); ok {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		matching = append(matching, w)
+	}
+	return
+}
+
+// signWebhook returns the signature of a webhook body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the event to the webhook with the client, retrying up
+// to retries times with exponential backoff until it is accepted.
+func deliverWebhook(w webhook, e Event, client *http.Client, retries int) (d webhookDelivery) {
+	body, _ := json.Marshal(e)
+	d = webhookDelivery{
+		ID:    checksum([]byte(fmt.Sprintf("%s/%s/%d", w.URL, body, time.Now().UnixNano())))[:16],
+		URL:   w.URL,
+		Event: e,
+	}
+	backoff := webhookBackoff
+	for d.Attempt = 1; d.Attempt <= retries+1; d.Attempt++ {
+		d.Status, d.Error = 0, ""
+		d.Time = time.Now().UnixNano() / 1000000
+		req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+		if err != nil {
+			d.Error = err.Error()
+			recordDelivery(d)
+			return
+		}
+		req.Header.Set("Content-Type", contentTypeJSON)
+		req.Header.Set("User-Agent", "patchitup")
+		req.Header.Set("X-Patchitup-Event", e.Type)
+		req.Header.Set("X-Patchitup-Delivery", d.ID)
+		req.Header.Set("X-Patchitup-Signature", signWebhook(w.Secret, body))
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			d.Status = resp.StatusCode
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				recordDelivery(d)
+				return
+			}
+			d.Error = resp.Status
+		} else {
+			d.Error = err.Error()
+		}
+		recordDelivery(d)
+		if d.Attempt <= retries {
+			log.Debugf("webhook %s failed (%s), retrying in %s", w.URL, d.Error, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Warnf("giving up on delivering %s event of %s/%s to %s", e.Type, e.Username, e.Filename, w.URL)
+	return
+}
+
+// recordDelivery appends the attempt to the delivery log, which is
+// compacted every webhookLogKeep attempts.
+func recordDelivery(d webhookDelivery) {
+	b, _ := json.Marshal(d)
+	webhooks.log.Lock()
+	defer webhooks.log.Unlock()
+	f, err := os.OpenFile(pathToWebhookLog(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	f.Write(append(b, '\n'))
+	f.Close()
+	webhooks.recorded++
+	if webhooks.recorded < webhookLogKeep {
+		return
+	}
+	webhooks.recorded = 0
+	err = compactDeliveryLog()
+	if err != nil {
+		log.Warnf("problem compacting %s: %s", pathToWebhookLog(), err)
+	}
+}
+
+// compactDeliveryLog keeps the latest webhookLogKeep attempts of each
+// webhook in the delivery log, which must be locked.
+func compactDeliveryLog() (err error) {
+	b, err := ioutil.ReadFile(pathToWebhookLog())
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	kept := make(map[string]int)
+	keep := make([]bool, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		var d webhookDelivery
+		if json.Unmarshal([]byte(lines[i]), &d) != nil || kept[d.URL] >= webhookLogKeep {
+			continue
+		}
+		kept[d.URL]++
+		keep[i] = true
+	}
+	var compacted bytes.Buffer
+	for i, line := range lines {
+		if keep[i] {
+			compacted.WriteString(line + "\n")
+		}
+	}
+	pathToTemp := pathToWebhookLog() + ".tmp"
+	err = ioutil.WriteFile(pathToTemp, compacted.Bytes(), 0755)
+	if err != nil {
+		return
+	}
+	return os.Rename(pathToTemp, pathToWebhookLog())
+}
+
+// listDeliveries returns the attempts to deliver the events of a user, the
+// latest last.
+func listDeliveries(username string) (deliveries []webhookDelivery, err error) {
+	webhooks.log.Lock()
+	b, err := ioutil.ReadFile(pathToWebhookLog())
+	webhooks.log.Unlock()
+	if err != nil {
+		// nothing delivered yet
+		err = nil
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		var d webhookDelivery
+		if json.Unmarshal([]byte(line), &d) != nil || d.Event.Username != username {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return
+}
+
+func handlerWebhookLog(c *gin.Context) {
+	deliveries, message, err := func(c *gin.Context) (deliveries []webhookDelivery, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		err = validateNames(sr.Username)
+		if err != nil {
+			return
+		}
+		deliveries, err = listDeliveries(sr.Username)
+		message = fmt.Sprintf("%d deliveries", len(deliveries))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:    message,
+		Success:    err == nil,
+		Deliveries: deliveries,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// handlerWebhookTest sends a test event to the webhooks of a user and waits
+// for the deliveries.
+func handlerWebhookTest(c *gin.Context) {
+	deliveries, message, err := func(c *gin.Context) (deliveries []webhookDelivery, message string, err error) {
+		var sr serverRequest
+		err = bindRequest(c, &sr)
+		if err != nil {
+			return
+		}
+		err = validateNames(sr.Username)
+		if err != nil {
+			return
+		}
+		e := Event{
+			Type:     EventTest,
+			Username: sr.Username,
+			Filename: sr.Filename,
+			Time:     time.Now().UnixNano() / 1000000,
+		}
+		matching := matchingWebhooks(e)
+		deliveries = make([]webhookDelivery, len(matching))
+		var wg sync.WaitGroup
+		for i, w := range matching {
+			wg.Add(1)
+			go func(i int, w webhook) {
+				defer wg.Done()
+				deliveries[i] = deliverWebhook(w, e, webhookTestClient, 0)
+			}(i, w)
+		}
+		wg.Wait()
+		message = fmt.Sprintf("sent test event to %d webhooks", len(matching))
+		return
+	}(c)
+	if err != nil {
+		message = err.Error()
+	}
+	sr := serverResponse{
+		Message:    message,
+		Success:    err == nil,
+		Deliveries: deliveries,
+	}
+	log.Infof("download: %s", humanize.Bytes(uint64(sendResponse(c, sr))))
+}
+
+// PingWebhooks sends a test event to the webhooks of the user on the server
+// and reports the deliveries.
+func PingWebhooks(address, username string) (err error) {
+	defer log.Flush()
+	c, err := handleConfiguration(address, username)
+	if err != nil {
+		return
+	}
+	err = requireFeature(c.ServerAddress, featureWebhooks)
+	if err != nil {
+		return
+	}
+	target, err := postToServer(c.ServerAddress+"/webhooks/test", serverRequest{
+		Username: c.Username,
+	})
+	if err != nil {
+		return
+	}
+	log.Info(target.Message)
+	for _, d := range target.Deliveries {
+		if d.Error != "" {
+			log.Warnf("%s: %s", d.URL, d.Error)
+		} else {
+			log.Infof("%s: %d", d.URL, d.Status)
+		}
+	}
+	return
+}
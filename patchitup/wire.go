@@ -0,0 +1,242 @@
+package patchitup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/pkg/errors"
+)
+
+// Requests and responses are JSON by default. A client can ask for the
+// compact binary encoding (CBOR) by accepting contentTypeBinary, and once a
+// server has responded with it, the client sends its requests in it too.
+// In the binary encoding compressed patches are sent as raw bytes instead
+// of base64, and line numbers as varint deltas instead of decimal text.
+const (
+	contentTypeBinary = "application/cbor"
+	contentTypeJSON   = "application/json"
+)
+
+// lineNumbers maps line hashes to the line numbers of the line
+type lineNumbers map[string][]int
+
+// MarshalCBOR encodes the line numbers of each hash as varint deltas.
+func (l lineNumbers) MarshalCBOR() ([]byte, error) {
+	if l == nil {
+		return cbor.Marshal(nil)
+	}
+	m := make(map[string][]byte, len(l))
+	buf := make([]byte, binary.MaxVarintLen64)
+	for h, nums := range l {
+		deltas := make([]byte, 0, len(nums))
+		last := 0
+		for _, num := range nums {
+			deltas = append(deltas, buf[:binary.PutVarint(buf, int64(num-last))]...)
+			last = num
+		}
+		m[h] = deltas
+	}
+	return cbor.Marshal(m)
+}
+
+// UnmarshalCBOR decodes line numbers encoded by MarshalCBOR.
+func (l *lineNumbers) UnmarshalCBOR(data []byte) (err error) {
+	var m map[string][]byte
+	err = cbor.Unmarshal(data, &m)
+	if err != nil || m == nil {
+		return
+	}
+	*l = make(lineNumbers, len(m))
+	for h, deltas := range m {
+		nums := []int{}
+		last := 0
+		for pos := 0; pos < len(deltas); {
+			delta, n := binary.Varint(deltas[pos:])
+			if n <= 0 {
+				return errors.New("malformed line numbers")
+			}
+			pos += n
+			last += int(delta)
+			nums = append(nums, last)
+		}
+		(*l)[h] = nums
+	}
+	return
+}
+
+// base64String is a string that the binary encoding sends as raw bytes when
+// it is base64, e.g. a compressed patch.
+type base64String string
+
+// MarshalCBOR encodes the string as bytes if it is base64.
+func (s base64String) MarshalCBOR() ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(string(s))
+	if err == nil && base64.StdEncoding.EncodeToString(b) == string(s) {
+		return cbor.Marshal(b)
+	}
+	return cbor.Marshal(string(s))
+}
+
+// UnmarshalCBOR decodes a string encoded by MarshalCBOR.
+func (s *base64String) UnmarshalCBOR(data []byte) (err error) {
+	var v interface{}
+	err = cbor.Unmarshal(data, &v)
+	if err != nil {
+		return
+	}
+	switch v := v.(type) {
+	case []byte:
+		*s = base64String(base64.StdEncoding.EncodeToString(v))
+	case string:
+		*s = base64String(v)
+	default:
+		err = errors.New("malformed string")
+	}
+	return
+}
+
+// bindRequest reads the request in the encoding it was sent with, and
+// checks that it can act as its user.
+func bindRequest(c *gin.Context, sr *serverRequest) (err error) {
+	err = decodeRequest(c, sr)
+	if err != nil {
+		return
+	}
+	return authorizeUser(c, sr.Username)
+}
+
+// decodeRequest reads the request in the encoding it was sent with.
+func decodeRequest(c *gin.Context, sr *serverRequest) (err error) {
+	if c.ContentType() != contentTypeBinary {
+		return c.ShouldBindJSON(sr)
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return
+	}
+	err = cbor.Unmarshal(body, sr)
+	if err != nil {
+		return
+	}
+	return binding.Validator.ValidateStruct(sr)
+}
+
+// sendResponse writes the response in the binary encoding if the client
+// accepts it, and returns the number of bytes sent.
+func sendResponse(c *gin.Context, sr serverResponse) int {
+	if strings.Contains(c.GetHeader("Accept"), contentTypeBinary) {
+		bSR, err := cbor.Marshal(sr)
+		if err == nil {
+			c.Data(http.StatusOK, contentTypeBinary, bSR)
+			return len(bSR)
+		}
+	}
+	bSR, _ := json.Marshal(sr)
+	c.Data(http.StatusOK, contentTypeJSON+"; charset=utf-8", bSR)
+	return len(bSR)
+}
+
+// binaryServers are the servers known to support the binary encoding
+var binaryServers = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// serverKey identifies the server of an endpoint address
+func serverKey(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func supportsBinary(address string) bool {
+	binaryServers.RLock()
+	defer binaryServers.RUnlock()
+	return binaryServers.m[serverKey(address)]
+}
+
+func setSupportsBinary(address string) {
+	binaryServers.Lock()
+	binaryServers.m[serverKey(address)] = true
+	binaryServers.Unlock()
+}
+
+// encodeRequest encodes a request for the server, returning the body and
+// its content type.
+func encodeRequest(address string, sr serverRequest) (body []byte, contentType string, err error) {
+	if supportsBinary(address) {
+		body, err = cbor.Marshal(sr)
+		contentType = contentTypeBinary
+		return
+	}
+	body, err = json.Marshal(sr)
+	contentType = contentTypeJSON
+	return
+}
+
+// decodeResponse decodes a response in the encoding given by its content type.
+func decodeResponse(address, contentType string, body []byte, target *serverResponse) (err error) {
+	if strings.HasPrefix(contentType, contentTypeBinary) {
+		setSupportsBinary(address)
+		return cbor.Unmarshal(body, target)
+	}
+	return json.NewDecoder(bytes.NewReader(body)).Decode(target)
+}
+
+// bandwidth keeps track of the bytes transferred with each server for each
+// user, and how many bytes it would have been in JSON, so that uploads to
+// several servers at once are counted apart.
+var bandwidth = struct {
+	sync.Mutex
+	transfers map[transferKey]*transfer
+}{transfers: make(map[transferKey]*transfer)}
+
+// transferKey identifies the transfers of a user with a server
+type transferKey struct {
+	address, username string
+}
+
+type transfer struct {
+	bytes, jsonBytes int
+}
+
+// addBandwidth counts a request of the user to the address, which is a
+// route of a server.
+func addBandwidth(address, username string, bytes, jsonBytes int) {
+	bandwidth.Lock()
+	defer bandwidth.Unlock()
+	for key, t := range bandwidth.transfers {
+		if key.username == username && strings.HasPrefix(address, key.address+"/") {
+			t.bytes += bytes
+			t.jsonBytes += jsonBytes
+		}
+	}
+}
+
+// resetBandwidth starts counting the transfers of the user with the server.
+func resetBandwidth(address, username string) {
+	bandwidth.Lock()
+	bandwidth.transfers[transferKey{address, username}] = &transfer{}
+	bandwidth.Unlock()
+}
+
+func getBandwidth(address, username string) (bytes, jsonBytes int) {
+	bandwidth.Lock()
+	defer bandwidth.Unlock()
+	if t, ok := bandwidth.transfers[transferKey{address, username}]; ok {
+		return t.bytes, t.jsonBytes
+	}
+	return
+}